@@ -0,0 +1,207 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package authenticity signs and verifies product authenticity certificates.
+//
+// A certificate is a compact JWS (RFC 7515) signed with Ed25519 (alg EdDSA, RFC 8037), so it is
+// small enough for a QR code. Manufacturers sign the claims returned by the QueryAuthenticityClaims
+// transaction with their own private key and record the token with IssueAuthenticityCertificate,
+// so the key never leaves them. A certificate is verified offline against a snapshot of the manufacturer keys
+// registered on the ledger, as returned by the QueryManufacturerKeys transaction:
+//
+//	keys, err := authenticity.ParseKeys(snapshot)
+//	claims, err := authenticity.Verify(token, keys)
+package authenticity
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Algorithm is the JWS algorithm of every certificate
+const Algorithm = "EdDSA"
+
+// TokenType is the JWS typ header of every certificate
+const TokenType = "product-authenticity+jws"
+
+// Verification errors
+var (
+	ErrMalformed    = errors.New("The certificate is malformed")
+	ErrUnknownKey   = errors.New("The certificate is signed with an unknown key")
+	ErrRevokedKey   = errors.New("The certificate is signed with a revoked key")
+	ErrBadSignature = errors.New("The certificate signature is invalid")
+)
+
+// Claims are the product facts a certificate attests to. TxID is the transaction that last
+// changed the product, so a certificate is tied to the state it was issued for.
+type Claims struct {
+	ProductID string `json:"pid"`
+	ModelID   string `json:"mid"`
+	ModelName string `json:"mdl"`
+	Make      string `json:"mk"`
+	Status    int    `json:"st"`
+	TxID      string `json:"tx"`
+	Issuer    string `json:"iss"`
+	IssuedAt  int64  `json:"iat"`
+}
+
+// Key is a manufacturer public key registered on the ledger. PublicKey is the base64 encoded
+// 32 byte Ed25519 key.
+type Key struct {
+	KeyID     string `json:"keyID"`
+	MSPID     string `json:"mspID"`
+	PublicKey string `json:"publicKey"`
+	Revoked   bool   `json:"revoked,omitempty"`
+}
+
+// KeySet indexes keys by key ID
+type KeySet map[string]*Key
+
+type header struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Type      string `json:"typ"`
+}
+
+// ParseKeys reads a JSON array of keys into a key set.
+func ParseKeys(data []byte) (KeySet, error) {
+	var keys []*Key
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("Failed to parse keys: %v", err)
+	}
+
+	set := KeySet{}
+	for _, key := range keys {
+		if _, err := DecodePublicKey(key.PublicKey); err != nil {
+			return nil, fmt.Errorf("The key %s is invalid: %v", key.KeyID, err)
+		}
+		set[key.KeyID] = key
+	}
+	return set, nil
+}
+
+// DecodePublicKey decodes a base64 encoded Ed25519 public key.
+func DecodePublicKey(encoded string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Expected %d bytes, got %d", ed25519.PublicKeySize, len(raw))
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// DecodePrivateKey decodes a base64 encoded Ed25519 private key, given either as the 32 byte
+// seed or as the 64 byte key.
+func DecodePrivateKey(encoded string) (ed25519.PrivateKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	switch len(raw) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(raw), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(raw), nil
+	}
+	return nil, fmt.Errorf("Expected %d or %d bytes, got %d", ed25519.SeedSize, ed25519.PrivateKeySize, len(raw))
+}
+
+// Sign issues a certificate for the claims with the private key registered under keyID. It runs
+// on the manufacturer's side; the ledger only verifies and records the resulting token.
+func Sign(claims *Claims, keyID string, privateKey ed25519.PrivateKey) (string, error) {
+	headerJSON, err := json.Marshal(header{Algorithm: Algorithm, KeyID: keyID, Type: TokenType})
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encode(headerJSON) + "." + encode(claimsJSON)
+	signature := ed25519.Sign(privateKey, []byte(signingInput))
+	return signingInput + "." + encode(signature), nil
+}
+
+// KeyID returns the ID of the key the certificate claims to be signed with, without verifying it.
+func KeyID(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrMalformed
+	}
+	var h header
+	if err := decodeJSON(parts[0], &h); err != nil {
+		return "", err
+	}
+	return h.KeyID, nil
+}
+
+// Verify checks the certificate signature against the key set and returns its claims. The
+// signing key must not be revoked and must belong to the organization named as issuer.
+func Verify(token string, keys KeySet) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var h header
+	if err := decodeJSON(parts[0], &h); err != nil {
+		return nil, err
+	}
+	if h.Algorithm != Algorithm || h.Type != TokenType {
+		return nil, fmt.Errorf("%w: unsupported header %s/%s", ErrMalformed, h.Algorithm, h.Type)
+	}
+	key, ok := keys[h.KeyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if key.Revoked {
+		return nil, ErrRevokedKey
+	}
+	publicKey, err := DecodePublicKey(key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("The key %s is invalid: %v", key.KeyID, err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if !ed25519.Verify(publicKey, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrBadSignature
+	}
+
+	var claims Claims
+	if err := decodeJSON(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if claims.Issuer != key.MSPID {
+		return nil, fmt.Errorf("The key %s belongs to %s, not the issuer %s", key.KeyID, key.MSPID, claims.Issuer)
+	}
+	return &claims, nil
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeJSON(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrMalformed
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package authenticity_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-samples/asset-transfer-fabcar/chaincode-go/authenticity"
+)
+
+var (
+	manufacturerKey = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	otherKey        = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize))
+)
+
+func testClaims() *authenticity.Claims {
+	return &authenticity.Claims{
+		ProductID: "PRODUCT-00001",
+		ModelID:   "MODEL-00001",
+		ModelName: "GalaxyS7",
+		Make:      "SAMSUNG",
+		Status:    1,
+		TxID:      "tx1",
+		Issuer:    "Org1MSP",
+		IssuedAt:  1577836800,
+	}
+}
+
+func testKeys(revoked bool) authenticity.KeySet {
+	return authenticity.KeySet{
+		"key-1": {
+			KeyID:     "key-1",
+			MSPID:     "Org1MSP",
+			PublicKey: base64.StdEncoding.EncodeToString(manufacturerKey.Public().(ed25519.PublicKey)),
+			Revoked:   revoked,
+		},
+	}
+}
+
+func sign(t *testing.T, claims *authenticity.Claims, keyID string, privateKey ed25519.PrivateKey) string {
+	token, err := authenticity.Sign(claims, keyID, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// signRaw signs an arbitrary header and payload, for tokens Sign would never produce.
+func signRaw(header string, payload string, privateKey ed25519.PrivateKey) string {
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(signingInput)))
+}
+
+func TestVerify(t *testing.T) {
+	valid := sign(t, testClaims(), "key-1", manufacturerKey)
+	parts := strings.Split(valid, ".")
+
+	tamperedClaims := testClaims()
+	tamperedClaims.Status = 3
+	tamperedJSON, err := json.Marshal(tamperedClaims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(tamperedJSON) + "." + parts[2]
+
+	otherIssuer := testClaims()
+	otherIssuer.Issuer = "Org2MSP"
+
+	claimsJSON, err := json.Marshal(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		keys    authenticity.KeySet
+		wantErr error
+	}{
+		{name: "valid", token: valid, keys: testKeys(false)},
+		{name: "tampered payload", token: tampered, keys: testKeys(false), wantErr: authenticity.ErrBadSignature},
+		{name: "signed with another key", token: sign(t, testClaims(), "key-1", otherKey), keys: testKeys(false), wantErr: authenticity.ErrBadSignature},
+		{name: "unregistered key", token: sign(t, testClaims(), "key-2", manufacturerKey), keys: testKeys(false), wantErr: authenticity.ErrUnknownKey},
+		{name: "revoked key", token: valid, keys: testKeys(true), wantErr: authenticity.ErrRevokedKey},
+		{name: "issuer not the key owner", token: sign(t, otherIssuer, "key-1", manufacturerKey), keys: testKeys(false), wantErr: errors.New("The key key-1 belongs to Org1MSP, not the issuer Org2MSP")},
+		{name: "unsupported token type", token: signRaw(`{"alg":"EdDSA","kid":"key-1","typ":"JWT"}`, string(claimsJSON), manufacturerKey), keys: testKeys(false), wantErr: authenticity.ErrMalformed},
+		{name: "unknown claim", token: signRaw(`{"alg":"EdDSA","kid":"key-1","typ":"product-authenticity+jws"}`, `{"pid":"PRODUCT-00001","x":1}`, manufacturerKey), keys: testKeys(false), wantErr: authenticity.ErrMalformed},
+		{name: "not a JWS", token: "abc.def", keys: testKeys(false), wantErr: authenticity.ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := authenticity.Verify(tt.token, tt.keys)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("Verify() error = %v", err)
+				}
+				if *claims != *testClaims() {
+					t.Fatalf("Verify() claims = %+v, want %+v", claims, testClaims())
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Verify() succeeded, want %v", tt.wantErr)
+			}
+			if !errors.Is(err, tt.wantErr) && err.Error() != tt.wantErr.Error() {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	publicKey := base64.StdEncoding.EncodeToString(manufacturerKey.Public().(ed25519.PublicKey))
+
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{name: "valid", data: `[{"keyID":"key-1","mspID":"Org1MSP","publicKey":"` + publicKey + `"}]`},
+		{name: "short key", data: `[{"keyID":"key-1","mspID":"Org1MSP","publicKey":"AAAA"}]`, wantErr: true},
+		{name: "not a list", data: `{"keyID":"key-1"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := authenticity.ParseKeys([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && keys["key-1"].MSPID != "Org1MSP" {
+				t.Fatalf("ParseKeys() = %+v", keys)
+			}
+		})
+	}
+}
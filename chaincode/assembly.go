@@ -0,0 +1,162 @@
+package chaincode
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Assembly is a product together with the components installed in it
+type Assembly struct {
+	Product    *Product    `json:"product"`
+	Components []*Assembly `json:"components,omitempty" metadata:"components,optional"`
+}
+
+// AttachComponent installs the component product with given id into the host product after
+// checking that the part is genuine, and records the pairing under the servicing identity. Only
+// the owner of the host or a refurbisher servicing it may attach components.
+func (s *ProductContract) AttachComponent(ctx contractapi.TransactionContextInterface, hostID string, componentID string) error {
+	return attachComponent(ctx, hostID, componentID)
+}
+
+func attachComponent(ctx contractapi.TransactionContextInterface, hostID string, componentID string) error {
+	if hostID == componentID {
+		return fmt.Errorf("The product %s cannot be attached to itself", hostID)
+	}
+
+	host, err := readProduct(ctx, hostID)
+	if err != nil {
+		return err
+	}
+	component, err := readProduct(ctx, componentID)
+	if err != nil {
+		return err
+	}
+	if component.ParentID != "" {
+		return fmt.Errorf("The product %s is already installed in %s", componentID, component.ParentID)
+	}
+	if isEndOfLife(host.Status) {
+		return fmt.Errorf("The product %s has reached end of life", hostID)
+	}
+	serviceOrg, err := assertServiceOrg(ctx, host)
+	if err != nil {
+		return err
+	}
+	if issue := hostIssue(host); issue != "" {
+		return fmt.Errorf("The product %s cannot take components: %s", hostID, issue)
+	}
+
+	// walk up from the host so a product never ends up inside one of its own components
+	for parentID := host.ParentID; parentID != ""; {
+		if parentID == componentID {
+			return fmt.Errorf("The product %s contains %s and cannot be attached to it", componentID, hostID)
+		}
+		parent, err := readProduct(ctx, parentID)
+		if err != nil {
+			return err
+		}
+		parentID = parent.ParentID
+	}
+
+	if issue := componentIssue(host, component, serviceOrg); issue != "" {
+		return fmt.Errorf("The product %s cannot be paired with %s: %s", componentID, hostID, issue)
+	}
+
+	host.Components = append(host.Components, componentID)
+	component.ParentID = hostID
+	if component.Owner != host.Owner {
+		component.Owner = host.Owner
+		if err := appendCustodyEvent(ctx, componentID, CustodyReceive, "", nil); err != nil {
+			return err
+		}
+	}
+
+	if err := putProduct(ctx, host); err != nil {
+		return err
+	}
+	if err := putProduct(ctx, component); err != nil {
+		return err
+	}
+	return recordPairing(ctx, hostID, componentID)
+}
+
+// DetachComponent removes the component product with given id from the host product. Only the
+// owner of the host or a refurbisher servicing it may detach components.
+func (s *ProductContract) DetachComponent(ctx contractapi.TransactionContextInterface, hostID string, componentID string) error {
+	return detachComponent(ctx, hostID, componentID)
+}
+
+func detachComponent(ctx contractapi.TransactionContextInterface, hostID string, componentID string) error {
+	host, err := readProduct(ctx, hostID)
+	if err != nil {
+		return err
+	}
+	if _, err := assertServiceOrg(ctx, host); err != nil {
+		return err
+	}
+	component, err := readProduct(ctx, componentID)
+	if err != nil {
+		return err
+	}
+	if component.ParentID != hostID {
+		return fmt.Errorf("The product %s is not installed in %s", componentID, hostID)
+	}
+
+	components := host.Components[:0]
+	for _, id := range host.Components {
+		if id != componentID {
+			components = append(components, id)
+		}
+	}
+	host.Components = components
+	component.ParentID = ""
+
+	if err := putProduct(ctx, host); err != nil {
+		return err
+	}
+	if err := putProduct(ctx, component); err != nil {
+		return err
+	}
+	return deletePairing(ctx, hostID, componentID)
+}
+
+// QueryProductAssembly returns the product with given id and the full tree of its components.
+func (s *QueryContract) QueryProductAssembly(ctx contractapi.TransactionContextInterface, id string) (*Assembly, error) {
+	product, err := readProduct(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	assembly := &Assembly{Product: product}
+	for _, componentID := range product.Components {
+		component, err := s.QueryProductAssembly(ctx, componentID)
+		if err != nil {
+			return nil, err
+		}
+		assembly.Components = append(assembly.Components, component)
+	}
+
+	return assembly, nil
+}
+
+// transferComponents hands every component installed in the product, recursively, to the owner
+// and records the receipt in their custody trails. The product itself is written by the caller.
+func transferComponents(ctx contractapi.TransactionContextInterface, product *Product, owner string) error {
+	for _, componentID := range product.Components {
+		component, err := readProduct(ctx, componentID)
+		if err != nil {
+			return err
+		}
+		component.Owner = owner
+		if err := appendCustodyEvent(ctx, componentID, CustodyReceive, "", nil); err != nil {
+			return err
+		}
+		if err := putProduct(ctx, component); err != nil {
+			return err
+		}
+		if err := transferComponents(ctx, component, owner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
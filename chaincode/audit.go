@@ -0,0 +1,257 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	auditObjectType           = "audit"
+	productDeletionObjectType = "productDeletion"
+)
+
+// Modifier identifies who submitted a change
+type Modifier struct {
+	MSPID   string `json:"mspID"`
+	Subject string `json:"subject"`
+}
+
+// AuditEntry is one change to a product. Entries of the audit trail carry the product as written,
+// entries of an identity's changes only reference it.
+type AuditEntry struct {
+	TxID       string    `json:"txID"`
+	Timestamp  string    `json:"timestamp"`
+	ProductID  string    `json:"productID"`
+	Function   string    `json:"function,omitempty" metadata:"function,optional"`
+	ModifiedBy *Modifier `json:"modifiedBy,omitempty" metadata:"modifiedBy,optional"`
+	Deleted    bool      `json:"deleted,omitempty" metadata:"deleted,optional"`
+	Product    *Product  `json:"product,omitempty" metadata:"product,optional"`
+}
+
+// QueryAuditTrail returns every change to the product with given id, oldest first, with who made
+// it and through which transaction. Changes written before identities were recorded have no
+// modifier.
+func (s *QueryContract) QueryAuditTrail(ctx contractapi.TransactionContextInterface, id string) ([]*AuditEntry, error) {
+	historyIterator, err := ctx.GetStub().GetHistoryForKey(id)
+	if err != nil {
+		return nil, err
+	}
+	defer historyIterator.Close()
+
+	trail := []*AuditEntry{}
+	for historyIterator.HasNext() {
+		modification, err := historyIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		timestamp, err := ptypes.Timestamp(modification.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		var entry *AuditEntry
+		if modification.IsDelete {
+			entry, err = readAuditEntry(ctx, productDeletionObjectType, []string{id, modification.TxId})
+		} else {
+			product, err := unmarshalProduct(modification.Value)
+			if err != nil {
+				return nil, err
+			}
+			if product.LastModifiedBy != nil && product.LastTxID == modification.TxId {
+				entry, err = readAuditEntry(ctx, auditObjectType, auditKey(product.LastModifiedBy, timestamp.UTC(), modification.TxId, id))
+				if err != nil {
+					return nil, err
+				}
+			}
+			if entry == nil {
+				entry = &AuditEntry{ModifiedBy: product.LastModifiedBy}
+			}
+			entry.Product = product
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			entry = &AuditEntry{}
+		}
+
+		entry.TxID = modification.TxId
+		entry.Timestamp = timestamp.UTC().Format(time.RFC3339)
+		entry.ProductID = id
+		entry.Deleted = modification.IsDelete
+		trail = append(trail, entry)
+	}
+	return trail, nil
+}
+
+// QueryChangesByIdentity returns the product changes made by the identity with given MSP ID and
+// certificate subject between from and to, RFC 3339 timestamps that may be left empty for an open
+// window. Admins may query any identity, others only identities of their own organization.
+func (s *QueryContract) QueryChangesByIdentity(ctx contractapi.TransactionContextInterface, mspID string, subject string, from string, to string) ([]*AuditEntry, error) {
+	callerMSPID, err := clientMSPID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if callerMSPID != mspID {
+		if err := assertAdmin(ctx); err != nil {
+			return nil, err
+		}
+	}
+	fromTime, err := parseWindowBound(from)
+	if err != nil {
+		return nil, err
+	}
+	toTime, err := parseWindowBound(to)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(auditObjectType, []string{mspID, subject})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	// keys sort by timestamp, so the scan stops at the end of the window
+	changes := []*AuditEntry{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var entry AuditEntry
+		err = json.Unmarshal(queryResponse.Value, &entry)
+		if err != nil {
+			return nil, err
+		}
+		timestamp, err := time.Parse(time.RFC3339, entry.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		if !fromTime.IsZero() && timestamp.Before(fromTime) {
+			continue
+		}
+		if !toTime.IsZero() && timestamp.After(toTime) {
+			break
+		}
+		changes = append(changes, &entry)
+	}
+	return changes, nil
+}
+
+// stampProduct records the invoker and transaction on the product about to be written, and
+// indexes the change under the invoker's identity.
+func stampProduct(ctx contractapi.TransactionContextInterface, product *Product) error {
+	entry, err := newAuditEntry(ctx, product.ID)
+	if err != nil {
+		return err
+	}
+	product.LastModifiedBy = entry.ModifiedBy
+	product.LastTxID = entry.TxID
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	return putAuditEntry(ctx, auditObjectType, auditKey(entry.ModifiedBy, now, entry.TxID, product.ID), entry)
+}
+
+// recordDeletion keeps who deleted the product, which the deleted state itself cannot carry.
+func recordDeletion(ctx contractapi.TransactionContextInterface, productID string) error {
+	entry, err := newAuditEntry(ctx, productID)
+	if err != nil {
+		return err
+	}
+	entry.Deleted = true
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	if err := putAuditEntry(ctx, auditObjectType, auditKey(entry.ModifiedBy, now, entry.TxID, productID), entry); err != nil {
+		return err
+	}
+	return putAuditEntry(ctx, productDeletionObjectType, []string{productID, entry.TxID}, entry)
+}
+
+func newAuditEntry(ctx contractapi.TransactionContextInterface, productID string) (*AuditEntry, error) {
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	subject, err := clientSubject(ctx)
+	if err != nil {
+		return nil, err
+	}
+	timestamp, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	function, _ := ctx.GetStub().GetFunctionAndParameters()
+
+	return &AuditEntry{
+		TxID:       ctx.GetStub().GetTxID(),
+		Timestamp:  timestamp,
+		ProductID:  productID,
+		Function:   function,
+		ModifiedBy: &Modifier{MSPID: mspID, Subject: subject},
+	}, nil
+}
+
+// auditKey orders an identity's changes by time, then transaction and product.
+func auditKey(modifier *Modifier, timestamp time.Time, txID string, productID string) []string {
+	return []string{modifier.MSPID, modifier.Subject, timestamp.Format(custodyKeyLayout), txID, productID}
+}
+
+func parseWindowBound(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("The time %s is not an RFC 3339 timestamp", value)
+	}
+	return t, nil
+}
+
+func readAuditEntry(ctx contractapi.TransactionContextInterface, objectType string, attributes []string) (*AuditEntry, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	entryJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	if entryJSON == nil {
+		return nil, nil
+	}
+
+	var entry AuditEntry
+	err = json.Unmarshal(entryJSON, &entry)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func putAuditEntry(ctx contractapi.TransactionContextInterface, objectType string, attributes []string, entry *AuditEntry) error {
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	key, err := ctx.GetStub().CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(key, entryJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-samples/asset-transfer-fabcar/chaincode-go/authenticity"
+)
+
+const (
+	manufacturerKeyObjectType         = "manufacturerKey"
+	authenticityCertificateObjectType = "authenticityCertificate"
+)
+
+// ManufacturerKey is an Ed25519 public key a manufacturer signs authenticity certificates with
+type ManufacturerKey struct {
+	KeyID        string `json:"keyID"`
+	MSPID        string `json:"mspID"`
+	PublicKey    string `json:"publicKey"`
+	RegisteredAt string `json:"registeredAt"`
+	Revoked      bool   `json:"revoked,omitempty" metadata:"revoked,optional"`
+	RevokedAt    string `json:"revokedAt,omitempty" metadata:"revokedAt,optional"`
+}
+
+// RegisterManufacturerKey registers the base64 encoded Ed25519 public key of the calling manufacturer.
+func (s *ModelContract) RegisterManufacturerKey(ctx contractapi.TransactionContextInterface, keyID string, publicKey string) error {
+	mspID, err := assertOrgRole(ctx, RoleManufacturer)
+	if err != nil {
+		return err
+	}
+	if _, err := authenticity.DecodePublicKey(publicKey); err != nil {
+		return fmt.Errorf("The public key is not a base64 encoded Ed25519 key: %v", err)
+	}
+	existing, err := readManufacturerKey(ctx, keyID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("The key %s already exists", keyID)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	return putManufacturerKey(ctx, &ManufacturerKey{
+		KeyID:        keyID,
+		MSPID:        mspID,
+		PublicKey:    publicKey,
+		RegisteredAt: now,
+	})
+}
+
+// RevokeManufacturerKey revokes a key, so certificates signed with it no longer verify. Only the
+// registering manufacturer or an admin may revoke it.
+func (s *ModelContract) RevokeManufacturerKey(ctx contractapi.TransactionContextInterface, keyID string) error {
+	key, err := queryManufacturerKey(ctx, keyID)
+	if err != nil {
+		return err
+	}
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	if key.MSPID != mspID {
+		if err := assertAdmin(ctx); err != nil {
+			return err
+		}
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	key.Revoked = true
+	key.RevokedAt = now
+	return putManufacturerKey(ctx, key)
+}
+
+// QueryManufacturerKey returns the manufacturer key with given id.
+func (s *QueryContract) QueryManufacturerKey(ctx contractapi.TransactionContextInterface, keyID string) (*ManufacturerKey, error) {
+	return queryManufacturerKey(ctx, keyID)
+}
+
+// queryManufacturerKey returns the manufacturer key with given id, failing when it does not exist.
+func queryManufacturerKey(ctx contractapi.TransactionContextInterface, keyID string) (*ManufacturerKey, error) {
+	key, err := readManufacturerKey(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, fmt.Errorf("The key %s does not exist", keyID)
+	}
+	return key, nil
+}
+
+// QueryManufacturerKeys returns every registered manufacturer key. The result is the key set
+// that authenticity.ParseKeys reads for offline verification.
+func (s *QueryContract) QueryManufacturerKeys(ctx contractapi.TransactionContextInterface) ([]*ManufacturerKey, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(manufacturerKeyObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var keys []*ManufacturerKey
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var key ManufacturerKey
+		err = json.Unmarshal(queryResponse.Value, &key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+
+	return keys, nil
+}
+
+// AuthenticityCertificate is a certificate signed by a manufacturer and recorded on the ledger
+type AuthenticityCertificate struct {
+	ProductID  string `json:"productID"`
+	KeyID      string `json:"keyID"`
+	Issuer     string `json:"issuer"`
+	Token      string `json:"token"`
+	RecordedAt string `json:"recordedAt"`
+	TxID       string `json:"txID"`
+}
+
+// QueryAuthenticityClaims returns the claims the calling manufacturer signs, with its own key,
+// to certify the product in its current state.
+func (s *QueryContract) QueryAuthenticityClaims(ctx contractapi.TransactionContextInterface, productID string) (*authenticity.Claims, error) {
+	product, err := readProduct(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	mspID, err := assertMakeManufacturer(ctx, product.Make)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	claims := productClaims(product, mspID)
+	claims.IssuedAt = now.Unix()
+	return claims, nil
+}
+
+// IssueAuthenticityCertificate records a certificate the calling manufacturer signed off the
+// ledger. The token must verify against the caller's registered, unrevoked key and attest the
+// product's current ID, model, make, status and last transaction.
+func (s *ProductContract) IssueAuthenticityCertificate(ctx contractapi.TransactionContextInterface, productID string, token string) error {
+	product, err := readProduct(ctx, productID)
+	if err != nil {
+		return err
+	}
+	mspID, err := assertMakeManufacturer(ctx, product.Make)
+	if err != nil {
+		return err
+	}
+	if product.Stolen {
+		return fmt.Errorf("The product %s is reported stolen", productID)
+	}
+
+	keyID, err := authenticity.KeyID(token)
+	if err != nil {
+		return err
+	}
+	key, err := queryManufacturerKey(ctx, keyID)
+	if err != nil {
+		return err
+	}
+	if key.MSPID != mspID {
+		return fmt.Errorf("The key %s belongs to %s, not %s", keyID, key.MSPID, mspID)
+	}
+	claims, err := authenticity.Verify(token, authenticity.KeySet{keyID: &authenticity.Key{
+		KeyID:     key.KeyID,
+		MSPID:     key.MSPID,
+		PublicKey: key.PublicKey,
+		Revoked:   key.Revoked,
+	}})
+	if err != nil {
+		return err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	expected := productClaims(product, mspID)
+	expected.IssuedAt = claims.IssuedAt
+	if *claims != *expected {
+		return fmt.Errorf("The certificate does not attest the current state of the product %s", productID)
+	}
+	if claims.IssuedAt > now.Unix() {
+		return fmt.Errorf("The certificate is issued after the transaction time")
+	}
+
+	certificate := &AuthenticityCertificate{
+		ProductID:  productID,
+		KeyID:      keyID,
+		Issuer:     mspID,
+		Token:      token,
+		RecordedAt: now.Format(time.RFC3339),
+		TxID:       ctx.GetStub().GetTxID(),
+	}
+	certificateJSON, err := json.Marshal(certificate)
+	if err != nil {
+		return err
+	}
+	stateKey, err := ctx.GetStub().CreateCompositeKey(authenticityCertificateObjectType, []string{productID, certificate.TxID})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(stateKey, certificateJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	return nil
+}
+
+// QueryAuthenticityCertificates returns the certificates recorded for the product.
+func (s *QueryContract) QueryAuthenticityCertificates(ctx contractapi.TransactionContextInterface, productID string) ([]*AuthenticityCertificate, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(authenticityCertificateObjectType, []string{productID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	certificates := []*AuthenticityCertificate{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var certificate AuthenticityCertificate
+		err = json.Unmarshal(queryResponse.Value, &certificate)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, &certificate)
+	}
+
+	return certificates, nil
+}
+
+// productClaims returns the claims attesting the product's current state on behalf of the issuer.
+func productClaims(product *Product, issuer string) *authenticity.Claims {
+	return &authenticity.Claims{
+		ProductID: product.ID,
+		ModelID:   product.ModelID,
+		ModelName: product.ModelName,
+		Make:      product.Make,
+		Status:    product.Status,
+		TxID:      product.LastTxID,
+		Issuer:    issuer,
+	}
+}
+
+func readManufacturerKey(ctx contractapi.TransactionContextInterface, keyID string) (*ManufacturerKey, error) {
+	stateKey, err := ctx.GetStub().CreateCompositeKey(manufacturerKeyObjectType, []string{keyID})
+	if err != nil {
+		return nil, err
+	}
+	keyJSON, err := ctx.GetStub().GetState(stateKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	if keyJSON == nil {
+		return nil, nil
+	}
+
+	var key ManufacturerKey
+	err = json.Unmarshal(keyJSON, &key)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func putManufacturerKey(ctx contractapi.TransactionContextInterface, key *ManufacturerKey) error {
+	keyJSON, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	stateKey, err := ctx.GetStub().CreateCompositeKey(manufacturerKeyObjectType, []string{key.KeyID})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(stateKey, keyJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	configObjectType        = "config"
+	configVersionObjectType = "configVersion"
+
+	defaultRequestRetentionHours = 7 * 24
+)
+
+// Features that can be switched off in the configuration
+const (
+	FeatureAssembly      = "assembly"
+	FeatureCertificates  = "certificates"
+	FeatureCustody       = "custody"
+	FeatureDocuments     = "documents"
+	FeatureEPCIS         = "epcis"
+	FeatureFirmware      = "firmware"
+	FeaturePassports     = "passports"
+	FeatureRecycling     = "recycling"
+	FeatureRefurbishment = "refurbishment"
+	FeatureRMA           = "rma"
+	FeatureSales         = "sales"
+	FeatureShipments     = "shipments"
+)
+
+// transactionFeatures maps the transactions that belong to a feature to its name
+var transactionFeatures = map[string]string{
+	"AttachComponent":              FeatureAssembly,
+	"DetachComponent":              FeatureAssembly,
+	"IssueAuthenticityCertificate": FeatureCertificates,
+	"RecordCustodyEvent":           FeatureCustody,
+	"AttachDocument":               FeatureDocuments,
+	"IngestEPCISEvents":            FeatureEPCIS,
+	"AddFirmwareRelease":           FeatureFirmware,
+	"RecordFirmwareUpdate":         FeatureFirmware,
+	"SetModelPassport":             FeaturePassports,
+	"SetProductPassportOverride":   FeaturePassports,
+	"ReleaseForRecycling":          FeatureRecycling,
+	"CollectForRecycling":          FeatureRecycling,
+	"RecordDismantling":            FeatureRecycling,
+	"CertifyDestruction":           FeatureRecycling,
+	"RefurbishProduct":             FeatureRefurbishment,
+	"RequestRMA":                   FeatureRMA,
+	"ApproveRMA":                   FeatureRMA,
+	"RejectRMA":                    FeatureRMA,
+	"ReceiveRMA":                   FeatureRMA,
+	"InspectRMA":                   FeatureRMA,
+	"DispositionRMA":               FeatureRMA,
+	"SellProduct":                  FeatureSales,
+	"ActivateDevice":               FeatureSales,
+	"PackShipment":                 FeatureShipments,
+	"DispatchShipment":             FeatureShipments,
+	"ReceiveShipment":              FeatureShipments,
+}
+
+// StatusTransition lists the statuses UpdateProduct may move a product to from the given status
+type StatusTransition struct {
+	From int   `json:"from"`
+	To   []int `json:"to"`
+}
+
+// ConfigSettings are the policies admins can change without upgrading the chaincode. Empty
+// settings leave the corresponding check off. Request IDs are remembered for the retention
+// window, in hours.
+type ConfigSettings struct {
+	AllowedStatuses       []int              `json:"allowedStatuses,omitempty" metadata:"allowedStatuses,optional"`
+	AllowedMakes          []string           `json:"allowedMakes,omitempty" metadata:"allowedMakes,optional"`
+	MaxDescriptionLength  int                `json:"maxDescriptionLength,omitempty" metadata:"maxDescriptionLength,optional"`
+	StatusTransitions     []StatusTransition `json:"statusTransitions,omitempty" metadata:"statusTransitions,optional"`
+	DisabledFeatures      []string           `json:"disabledFeatures,omitempty" metadata:"disabledFeatures,optional"`
+	RequestRetentionHours int                `json:"requestRetentionHours"`
+}
+
+// Config is a version of the on-ledger configuration. Version 0 is the built-in default, in
+// force until an admin first sets the configuration.
+type Config struct {
+	Version   int            `json:"version"`
+	Settings  ConfigSettings `json:"settings"`
+	UpdatedBy string         `json:"updatedBy,omitempty" metadata:"updatedBy,optional"`
+	UpdatedAt string         `json:"updatedAt,omitempty" metadata:"updatedAt,optional"`
+	TxID      string         `json:"txID,omitempty" metadata:"txID,optional"`
+}
+
+// GetConfig returns the configuration in force.
+func (s *AdminContract) GetConfig(ctx contractapi.TransactionContextInterface) (*Config, error) {
+	return loadConfig(ctx)
+}
+
+// GetConfigHistory returns every version of the configuration, oldest first.
+func (s *AdminContract) GetConfigHistory(ctx contractapi.TransactionContextInterface) ([]*Config, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(configVersionObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	configs := []*Config{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var config Config
+		err = json.Unmarshal(queryResponse.Value, &config)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, &config)
+	}
+	return configs, nil
+}
+
+// SetConfig replaces the configuration and returns the new version. The expected version must be
+// the one in force, so that concurrent edits do not silently overwrite each other.
+func (s *AdminContract) SetConfig(ctx contractapi.TransactionContextInterface, settings ConfigSettings, expectedVersion int) (*Config, error) {
+	if err := validateConfigSettings(&settings); err != nil {
+		return nil, err
+	}
+	current, err := loadConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current.Version != expectedVersion {
+		return nil, fmt.Errorf("The configuration is at version %d, not %d", current.Version, expectedVersion)
+	}
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{
+		Version:   current.Version + 1,
+		Settings:  settings,
+		UpdatedBy: mspID,
+		UpdatedAt: now,
+		TxID:      ctx.GetStub().GetTxID(),
+	}
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	// the configuration lives under a composite key, out of the range of product keys
+	key, err := ctx.GetStub().CreateCompositeKey(configObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(key, configJSON); err != nil {
+		return nil, fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	// every version is kept, under a fixed-width version so that they list in order
+	versionKey, err := ctx.GetStub().CreateCompositeKey(configVersionObjectType, []string{fmt.Sprintf("%010d", config.Version)})
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(versionKey, configJSON); err != nil {
+		return nil, fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	return config, nil
+}
+
+// loadConfig returns the configuration the transaction context loaded before the transaction,
+// reading it from the world state for contexts that do not carry one.
+func loadConfig(ctx contractapi.TransactionContextInterface) (*Config, error) {
+	if configured, ok := ctx.(TransactionContextInterface); ok && configured.GetConfig() != nil {
+		return configured.GetConfig(), nil
+	}
+	return readConfig(ctx)
+}
+
+// readConfig reads the configuration from the world state, or returns the default.
+func readConfig(ctx contractapi.TransactionContextInterface) (*Config, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(configObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	configJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	if configJSON == nil {
+		return &Config{Settings: ConfigSettings{RequestRetentionHours: defaultRequestRetentionHours}}, nil
+	}
+
+	var config Config
+	err = json.Unmarshal(configJSON, &config)
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func validateConfigSettings(settings *ConfigSettings) error {
+	if settings.MaxDescriptionLength < 0 {
+		return fmt.Errorf("The maximum description length must not be negative")
+	}
+	if settings.RequestRetentionHours < 1 {
+		return fmt.Errorf("The request retention must be at least one hour")
+	}
+	known := map[string]bool{}
+	for _, feature := range transactionFeatures {
+		known[feature] = true
+	}
+	for _, feature := range settings.DisabledFeatures {
+		if !known[feature] {
+			return fmt.Errorf("The feature %s is not known", feature)
+		}
+	}
+	for _, transition := range settings.StatusTransitions {
+		if len(settings.AllowedStatuses) > 0 && !containsInt(settings.AllowedStatuses, transition.From) {
+			return fmt.Errorf("The transition from status %d starts at a status that is not allowed", transition.From)
+		}
+	}
+	return nil
+}
+
+// assertFeatureEnabled fails when the transaction belongs to a feature the configuration disables.
+func assertFeatureEnabled(config *Config, function string) error {
+	if i := strings.LastIndex(function, ":"); i >= 0 {
+		function = function[i+1:]
+	}
+	feature, ok := transactionFeatures[function]
+	if !ok {
+		return nil
+	}
+	for _, disabled := range config.Settings.DisabledFeatures {
+		if disabled == feature {
+			return fmt.Errorf("The transaction %s is unavailable while the %s feature is disabled", function, feature)
+		}
+	}
+	return nil
+}
+
+// validateProductFields checks the status, make and description of a product against the
+// configuration.
+func validateProductFields(ctx contractapi.TransactionContextInterface, status int, make string, description string) error {
+	config, err := loadConfig(ctx)
+	if err != nil {
+		return err
+	}
+	settings := config.Settings
+	if len(settings.AllowedStatuses) > 0 && !containsInt(settings.AllowedStatuses, status) {
+		return fmt.Errorf("The status %d is not allowed", status)
+	}
+	if len(settings.AllowedMakes) > 0 && !containsString(settings.AllowedMakes, make) {
+		return fmt.Errorf("The make %s is not allowed", make)
+	}
+	if settings.MaxDescriptionLength > 0 && len([]rune(description)) > settings.MaxDescriptionLength {
+		return fmt.Errorf("The description exceeds %d characters", settings.MaxDescriptionLength)
+	}
+	return nil
+}
+
+// validateStatusTransition checks a status change against the configured transitions. Statuses
+// without a configured transition may change to any status.
+func validateStatusTransition(ctx contractapi.TransactionContextInterface, from int, to int) error {
+	if from == to {
+		return nil
+	}
+	config, err := loadConfig(ctx)
+	if err != nil {
+		return err
+	}
+	for _, transition := range config.Settings.StatusTransitions {
+		if transition.From == from && !containsInt(transition.To, to) {
+			return fmt.Errorf("The status cannot change from %d to %d", from, to)
+		}
+	}
+	return nil
+}
+
+// requestRetention returns for how long request IDs are remembered.
+func requestRetention(ctx contractapi.TransactionContextInterface) (time.Duration, error) {
+	config, err := loadConfig(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(config.Settings.RequestRetentionHours) * time.Hour, nil
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package chaincode
+
+import (
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// TransactionContextInterface is the transaction context every contract of the chaincode
+// receives. Besides the stub and client identity it carries the caller's MSP ID and the on-ledger
+// configuration, resolved once before the transaction, and the products changed by the
+// transaction, published as an event after it.
+type TransactionContextInterface interface {
+	contractapi.TransactionContextInterface
+	GetMSPID() string
+	GetConfig() *Config
+	MarkProductChanged(productID string)
+	GetChangedProducts() []string
+}
+
+// TransactionContext implements TransactionContextInterface
+type TransactionContext struct {
+	contractapi.TransactionContext
+	mspID           string
+	config          *Config
+	changedProducts map[string]bool
+	stats           *pendingStats
+}
+
+// GetMSPID returns the MSP ID of the submitting organization, or "" before it is resolved.
+func (ctx *TransactionContext) GetMSPID() string {
+	return ctx.mspID
+}
+
+// GetConfig returns the configuration in force, or nil before it is loaded.
+func (ctx *TransactionContext) GetConfig() *Config {
+	return ctx.config
+}
+
+// MarkProductChanged records that the transaction wrote or deleted the product.
+func (ctx *TransactionContext) MarkProductChanged(productID string) {
+	if ctx.changedProducts == nil {
+		ctx.changedProducts = map[string]bool{}
+	}
+	ctx.changedProducts[productID] = true
+}
+
+// GetChangedProducts returns the IDs of the products changed by the transaction, sorted.
+func (ctx *TransactionContext) GetChangedProducts() []string {
+	productIDs := make([]string, 0, len(ctx.changedProducts))
+	for productID := range ctx.changedProducts {
+		productIDs = append(productIDs, productID)
+	}
+	sort.Strings(productIDs)
+	return productIDs
+}
+
+// markProductChanged records the change on contexts that track changes, and is a no-op otherwise.
+func markProductChanged(ctx contractapi.TransactionContextInterface, productID string) {
+	if tracking, ok := ctx.(TransactionContextInterface); ok {
+		tracking.MarkProductChanged(productID)
+	}
+}
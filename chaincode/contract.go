@@ -0,0 +1,208 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// productsChangedEvent is the chaincode event published after a transaction that changed products
+const productsChangedEvent = "ProductsChanged"
+
+// ProductsChanged is the payload of the ProductsChanged chaincode event
+type ProductsChanged struct {
+	TxID       string   `json:"txID"`
+	Function   string   `json:"function"`
+	ProductIDs []string `json:"productIDs"`
+}
+
+// ProductContract provides the transactions that register products and move them through
+// sale, service, shipment, custody and end of life
+type ProductContract struct {
+	contract
+}
+
+// ModelContract provides the transactions manufacturers use to maintain models, their
+// passports and their signing keys
+type ModelContract struct {
+	contract
+}
+
+// AdminContract provides the transactions reserved to admins
+type AdminContract struct {
+	contract
+}
+
+// QueryContract provides the read-only transactions
+type QueryContract struct {
+	contract
+}
+
+// Contracts returns every contract of the chaincode, the product contract first so that it
+// serves function names given without a contract name.
+func Contracts() []contractapi.ContractInterface {
+	return []contractapi.ContractInterface{
+		new(ProductContract),
+		new(ModelContract),
+		new(AdminContract),
+		new(QueryContract),
+	}
+}
+
+// contract wires the shared transaction context and hooks into every contract.
+type contract struct {
+	contractapi.Contract
+}
+
+// GetTransactionContextHandler returns the custom transaction context.
+func (c *contract) GetTransactionContextHandler() contractapi.SettableTransactionContextInterface {
+	return new(TransactionContext)
+}
+
+// GetBeforeTransaction returns the hook run before every transaction.
+func (c *contract) GetBeforeTransaction() interface{} {
+	return beforeTransaction
+}
+
+// GetAfterTransaction returns the hook run after every successful transaction.
+func (c *contract) GetAfterTransaction() interface{} {
+	return afterTransaction
+}
+
+// GetUnknownTransaction returns the handler for functions the contract does not define.
+func (c *contract) GetUnknownTransaction() interface{} {
+	return unknownTransaction
+}
+
+// GetBeforeTransaction returns the hook run before every product transaction, which also checks
+// that the transaction is not paused.
+func (c *ProductContract) GetBeforeTransaction() interface{} {
+	return pausableBeforeTransaction
+}
+
+// GetBeforeTransaction returns the hook run before every model transaction, which also checks
+// that the transaction is not paused.
+func (c *ModelContract) GetBeforeTransaction() interface{} {
+	return pausableBeforeTransaction
+}
+
+// GetBeforeTransaction returns the hook run before every admin transaction, which also checks
+// that the caller is an admin.
+func (c *AdminContract) GetBeforeTransaction() interface{} {
+	return func(ctx TransactionContextInterface) error {
+		if err := beforeTransaction(ctx); err != nil {
+			return err
+		}
+		return assertAdmin(ctx)
+	}
+}
+
+// GetEvaluateTransactions marks the admin queries as evaluate transactions.
+func (c *AdminContract) GetEvaluateTransactions() []string {
+	return []string{"QueryProductEndorsementPolicy", "GetConfig", "GetConfigHistory", "GetMigrationProgress", "CheckIntegrity", "QueryQuarantinedRecords", "GetPauseHistory"}
+}
+
+// GetEvaluateTransactions marks every query as an evaluate transaction.
+func (c *QueryContract) GetEvaluateTransactions() []string {
+	return transactionNames(reflect.TypeOf(c))
+}
+
+// beforeTransaction resolves the caller's organization and the configuration, which every
+// transaction needs, rejects transactions of disabled features and logs the call.
+func beforeTransaction(ctx TransactionContextInterface) error {
+	tc, ok := ctx.(*TransactionContext)
+	if !ok {
+		return fmt.Errorf("Unexpected transaction context %T", ctx)
+	}
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	tc.mspID = mspID
+	config, err := readConfig(ctx)
+	if err != nil {
+		return err
+	}
+	tc.config = config
+
+	function, _ := ctx.GetStub().GetFunctionAndParameters()
+	log.Printf("%s %s by %s", ctx.GetStub().GetTxID(), function, mspID)
+	return assertFeatureEnabled(config, function)
+}
+
+func pausableBeforeTransaction(ctx TransactionContextInterface) error {
+	if err := beforeTransaction(ctx); err != nil {
+		return err
+	}
+	return assertNotPaused(ctx)
+}
+
+// afterTransaction publishes the products the transaction changed as a single chaincode event,
+// since Fabric keeps only one event per transaction.
+func afterTransaction(ctx TransactionContextInterface, result interface{}) error {
+	productIDs := ctx.GetChangedProducts()
+	if len(productIDs) == 0 {
+		return nil
+	}
+
+	function, _ := ctx.GetStub().GetFunctionAndParameters()
+	payload, err := json.Marshal(ProductsChanged{
+		TxID:       ctx.GetStub().GetTxID(),
+		Function:   function,
+		ProductIDs: productIDs,
+	})
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().SetEvent(productsChangedEvent, payload); err != nil {
+		return fmt.Errorf("Failed to set event: %v", err)
+	}
+	return nil
+}
+
+// unknownTransaction rejects a function the contract does not define, pointing to the contract
+// that does when there is one.
+func unknownTransaction(ctx TransactionContextInterface) error {
+	function, _ := ctx.GetStub().GetFunctionAndParameters()
+	contractName, name := "", function
+	if i := strings.LastIndex(function, ":"); i >= 0 {
+		contractName, name = function[:i], function[i+1:]
+	}
+	if name != "" {
+		name = strings.ToUpper(name[:1]) + name[1:]
+	}
+
+	for _, other := range Contracts() {
+		otherName := reflect.TypeOf(other).Elem().Name()
+		for _, transaction := range transactionNames(reflect.TypeOf(other)) {
+			if transaction == name {
+				return fmt.Errorf("The function %s is not defined by this contract, call it as %s:%s", name, otherName, name)
+			}
+		}
+	}
+	if contractName == "" {
+		contractName = reflect.TypeOf(Contracts()[0]).Elem().Name()
+	}
+	return fmt.Errorf("The function %s is not defined by %s or any other contract of the chaincode", name, contractName)
+}
+
+// transactionNames lists the transaction functions of a contract type: its exported methods
+// taking a transaction context.
+func transactionNames(contractType reflect.Type) []string {
+	contextType := reflect.TypeOf((*contractapi.TransactionContextInterface)(nil)).Elem()
+
+	names := []string{}
+	for i := 0; i < contractType.NumMethod(); i++ {
+		method := contractType.Method(i)
+		if method.Type.NumIn() > 1 && method.Type.In(1) == contextType {
+			names = append(names, method.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
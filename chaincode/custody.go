@@ -0,0 +1,199 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const custodyObjectType = "custody"
+
+// custodyKeyLayout keeps nanoseconds at a fixed width so that keys sort in time order.
+const custodyKeyLayout = "2006-01-02T15:04:05.000000000Z"
+
+// Custody actions
+const (
+	CustodyHandoff = "handoff"
+	CustodyReceive = "receive"
+	CustodyObserve = "observe"
+)
+
+var custodyActions = map[string]bool{CustodyHandoff: true, CustodyReceive: true, CustodyObserve: true}
+
+// CustodyEvent records an organization handling a product. A handoff names the organization
+// expected to receive it next.
+type CustodyEvent struct {
+	ProductID  string    `json:"productID"`
+	Action     string    `json:"action"`
+	HandlerMSP string    `json:"handlerMSP"`
+	HandlerID  string    `json:"handlerID"`
+	To         string    `json:"to,omitempty" metadata:"to,optional"`
+	Location   *Location `json:"location,omitempty" metadata:"location,optional"`
+	RecordedAt string    `json:"recordedAt"`
+	TxID       string    `json:"txID"`
+}
+
+// CustodyHop is a custody event with the holder after it. Gap explains a change of holder that
+// no handoff accounts for.
+type CustodyHop struct {
+	Event  *CustodyEvent `json:"event"`
+	Holder string        `json:"holder"`
+	Gap    string        `json:"gap,omitempty" metadata:"gap,optional"`
+}
+
+// CustodyChain is the custody trail of a product, oldest hop first
+type CustodyChain struct {
+	ProductID string        `json:"productID"`
+	Holder    string        `json:"holder,omitempty" metadata:"holder,optional"`
+	PendingTo string        `json:"pendingTo,omitempty" metadata:"pendingTo,optional"`
+	Hops      []*CustodyHop `json:"hops"`
+	Gaps      int           `json:"gaps"`
+}
+
+// RecordCustodyEvent appends a handoff, receive or observe event by the caller to the product's
+// custody trail. When the caller is the holder, or the receiver of a pending handoff, the
+// location also becomes the product's current location.
+func (s *ProductContract) RecordCustodyEvent(ctx contractapi.TransactionContextInterface, productID string, action string, to string, location Location) error {
+	if !custodyActions[action] {
+		return fmt.Errorf("The custody action %s is not one of %s, %s or %s", action, CustodyHandoff, CustodyReceive, CustodyObserve)
+	}
+	if (action == CustodyHandoff) != (to != "") {
+		return fmt.Errorf("Only a %s names the receiving organization", CustodyHandoff)
+	}
+	product, err := readProduct(ctx, productID)
+	if err != nil {
+		return err
+	}
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	if action == CustodyHandoff && to == mspID {
+		return fmt.Errorf("The product %s cannot be handed off to its holder %s", productID, mspID)
+	}
+	if action == CustodyHandoff && isEndOfLife(product.Status) {
+		return fmt.Errorf("The product %s has reached end of life", productID)
+	}
+	if err := validateLocation(&location, mspID); err != nil {
+		return err
+	}
+
+	chain, err := custodyChain(ctx, productID)
+	if err != nil {
+		return err
+	}
+	if chain.Holder == "" || chain.Holder == mspID || chain.PendingTo == mspID {
+		product.Location = &location
+		if err := putProduct(ctx, product); err != nil {
+			return err
+		}
+	}
+
+	return appendCustodyEvent(ctx, productID, action, to, &location)
+}
+
+// QueryCustodyChain returns the custody trail of the product with the handler at each hop and
+// the gaps where it changed holder without a matching handoff.
+func (s *QueryContract) QueryCustodyChain(ctx contractapi.TransactionContextInterface, productID string) (*CustodyChain, error) {
+	exists, err := productExists(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("The product %s does not exist", productID)
+	}
+	return custodyChain(ctx, productID)
+}
+
+// custodyChain replays the custody events of the product. The holder passes on when the receiver
+// named by a handoff handles the product; any other organization handling it is a gap.
+func custodyChain(ctx contractapi.TransactionContextInterface, productID string) (*CustodyChain, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(custodyObjectType, []string{productID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	chain := &CustodyChain{ProductID: productID, Hops: []*CustodyHop{}}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var event CustodyEvent
+		err = json.Unmarshal(queryResponse.Value, &event)
+		if err != nil {
+			return nil, err
+		}
+
+		hop := &CustodyHop{Event: &event}
+		handler := event.HandlerMSP
+		switch {
+		case chain.Holder == "" || handler == chain.PendingTo:
+			chain.Holder = handler
+			chain.PendingTo = ""
+		case handler != chain.Holder:
+			if chain.PendingTo != "" {
+				hop.Gap = fmt.Sprintf("Handed off to %s but handled by %s", chain.PendingTo, handler)
+			} else {
+				hop.Gap = fmt.Sprintf("Held by %s but handled by %s without a handoff", chain.Holder, handler)
+			}
+			chain.Holder = handler
+			chain.PendingTo = ""
+			chain.Gaps++
+		}
+		if event.Action == CustodyHandoff {
+			chain.PendingTo = event.To
+		}
+		hop.Holder = chain.Holder
+		chain.Hops = append(chain.Hops, hop)
+	}
+
+	return chain, nil
+}
+
+// appendCustodyEvent records a custody event by the caller for the product.
+func appendCustodyEvent(ctx contractapi.TransactionContextInterface, productID string, action string, to string, location *Location) error {
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	handlerID, err := clientID(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	recordedAt := now.Format(time.RFC3339)
+
+	event := CustodyEvent{
+		ProductID:  productID,
+		Action:     action,
+		HandlerMSP: mspID,
+		HandlerID:  handlerID,
+		To:         to,
+		Location:   location,
+		RecordedAt: recordedAt,
+		TxID:       ctx.GetStub().GetTxID(),
+	}
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	// keys sort by timestamp, so a range over the product prefix yields the trail in order
+	key, err := ctx.GetStub().CreateCompositeKey(custodyObjectType, []string{productID, now.Format(custodyKeyLayout), event.TxID})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(key, eventJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package chaincode
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const documentObjectType = "document"
+
+// Document types
+const (
+	DocumentInspection  = "inspection"
+	DocumentInvoice     = "invoice"
+	DocumentPhoto       = "photo"
+	DocumentCertificate = "certificate"
+	DocumentManual      = "manual"
+	DocumentOther       = "other"
+)
+
+var documentTypes = map[string]bool{
+	DocumentInspection:  true,
+	DocumentInvoice:     true,
+	DocumentPhoto:       true,
+	DocumentCertificate: true,
+	DocumentManual:      true,
+	DocumentOther:       true,
+}
+
+// DocumentAnchor is the metadata and content hash of an off-chain document about a product
+type DocumentAnchor struct {
+	ProductID  string `json:"productID"`
+	Type       string `json:"type"`
+	Hash       string `json:"hash"`
+	Size       int64  `json:"size"`
+	URI        string `json:"uri"`
+	UploadedBy string `json:"uploadedBy"`
+	Uploader   string `json:"uploader"`
+	UploadedAt string `json:"uploadedAt"`
+	TxID       string `json:"txID"`
+}
+
+// DocumentVerification tells whether a file hash is anchored under a product
+type DocumentVerification struct {
+	ProductID string          `json:"productID"`
+	Hash      string          `json:"hash"`
+	Verified  bool            `json:"verified"`
+	Document  *DocumentAnchor `json:"document,omitempty" metadata:"document,optional"`
+}
+
+// AttachDocument anchors the SHA-256 hash, size and off-chain URI of a document under the
+// product. The file itself never touches the ledger. The owner and organizations holding a
+// registered role may attach documents.
+func (s *ProductContract) AttachDocument(ctx contractapi.TransactionContextInterface, productID string, docType string, hash string, size int64, uri string) error {
+	if !documentTypes[docType] {
+		return fmt.Errorf("The document type %s is not one of inspection, invoice, photo, certificate, manual or other", docType)
+	}
+	hash, err := normalizeSHA256(hash)
+	if err != nil {
+		return err
+	}
+	if size <= 0 {
+		return fmt.Errorf("The document size must be positive")
+	}
+	if u, err := url.Parse(uri); err != nil || u.Scheme == "" {
+		return fmt.Errorf("The document URI %s is not an absolute URI", uri)
+	}
+
+	product, err := readProduct(ctx, productID)
+	if err != nil {
+		return err
+	}
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	if product.Owner != mspID {
+		roles, err := orgRoles(ctx, mspID)
+		if err != nil {
+			return err
+		}
+		if len(roles) == 0 {
+			return fmt.Errorf("The organization %s neither owns the product %s nor holds a registered role", mspID, productID)
+		}
+	}
+
+	existing, err := readDocument(ctx, productID, hash)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("The document %s is already attached to %s", hash, productID)
+	}
+
+	uploader, err := clientID(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	document := DocumentAnchor{
+		ProductID:  productID,
+		Type:       docType,
+		Hash:       hash,
+		Size:       size,
+		URI:        uri,
+		UploadedBy: mspID,
+		Uploader:   uploader,
+		UploadedAt: now,
+		TxID:       ctx.GetStub().GetTxID(),
+	}
+	documentJSON, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+	key, err := ctx.GetStub().CreateCompositeKey(documentObjectType, []string{productID, hash})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(key, documentJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	return nil
+}
+
+// VerifyDocument confirms the integrity of a file by looking up its SHA-256 hash under the product.
+func (s *QueryContract) VerifyDocument(ctx contractapi.TransactionContextInterface, productID string, hash string) (*DocumentVerification, error) {
+	hash, err := normalizeSHA256(hash)
+	if err != nil {
+		return nil, err
+	}
+	exists, err := productExists(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("The product %s does not exist", productID)
+	}
+
+	document, err := readDocument(ctx, productID, hash)
+	if err != nil {
+		return nil, err
+	}
+	return &DocumentVerification{
+		ProductID: productID,
+		Hash:      hash,
+		Verified:  document != nil,
+		Document:  document,
+	}, nil
+}
+
+// QueryProductDocuments lists the documents attached to the product, optionally only those of
+// the given type.
+func (s *QueryContract) QueryProductDocuments(ctx contractapi.TransactionContextInterface, productID string, docType string) ([]*DocumentAnchor, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(documentObjectType, []string{productID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	documents := []*DocumentAnchor{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var document DocumentAnchor
+		err = json.Unmarshal(queryResponse.Value, &document)
+		if err != nil {
+			return nil, err
+		}
+		if docType == "" || document.Type == docType {
+			documents = append(documents, &document)
+		}
+	}
+
+	return documents, nil
+}
+
+func readDocument(ctx contractapi.TransactionContextInterface, productID string, hash string) (*DocumentAnchor, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(documentObjectType, []string{productID, hash})
+	if err != nil {
+		return nil, err
+	}
+	documentJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	if documentJSON == nil {
+		return nil, nil
+	}
+
+	var document DocumentAnchor
+	err = json.Unmarshal(documentJSON, &document)
+	if err != nil {
+		return nil, err
+	}
+	return &document, nil
+}
+
+// normalizeSHA256 validates a hex encoded SHA-256 digest, with or without the sha256: prefix,
+// and returns it in the prefixed lower case form stored on the ledger.
+func normalizeSHA256(hash string) (string, error) {
+	digest := strings.TrimPrefix(strings.ToLower(hash), "sha256:")
+	if raw, err := hex.DecodeString(digest); err != nil || len(raw) != 32 {
+		return "", fmt.Errorf("The hash %s is not a hex encoded SHA-256 digest", hash)
+	}
+	return "sha256:" + digest, nil
+}
@@ -0,0 +1,207 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/statebased"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const endorsementOverrideObjectType = "endorsementOverride"
+
+// EndorsementOverride replaces the owner-only endorsement policy of a product until an admin
+// resets it
+type EndorsementOverride struct {
+	ProductID string   `json:"productID"`
+	Orgs      []string `json:"orgs"`
+	Reason    string   `json:"reason"`
+	SetBy     string   `json:"setBy"`
+	SetAt     string   `json:"setAt"`
+}
+
+// EndorsementPolicy lists the organizations whose peers must all endorse a change to a product
+type EndorsementPolicy struct {
+	ProductID string               `json:"productID"`
+	Orgs      []string             `json:"orgs"`
+	Override  *EndorsementOverride `json:"override,omitempty" metadata:"override,optional"`
+}
+
+// QueryProductEndorsementPolicy returns the key-level endorsement policy of the product with given
+// id. Products without one fall back to the chaincode endorsement policy and list no orgs.
+func (s *AdminContract) QueryProductEndorsementPolicy(ctx contractapi.TransactionContextInterface, productID string) (*EndorsementPolicy, error) {
+	exists, err := productExists(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("The product %s does not exist", productID)
+	}
+	orgs, err := endorsingOrgs(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	override, err := readEndorsementOverride(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	return &EndorsementPolicy{ProductID: productID, Orgs: orgs, Override: override}, nil
+}
+
+// SetProductEndorsementPolicy requires peers of all the given organizations to endorse changes to
+// the product, instead of the owner's alone, until the policy is reset.
+func (s *AdminContract) SetProductEndorsementPolicy(ctx contractapi.TransactionContextInterface, productID string, orgs []string, reason string) error {
+	if len(orgs) == 0 {
+		return fmt.Errorf("The endorsement policy needs at least one organization")
+	}
+	if reason == "" {
+		return fmt.Errorf("A reason is required to override the endorsement policy")
+	}
+	product, err := readProduct(ctx, productID)
+	if err != nil {
+		return err
+	}
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	override := &EndorsementOverride{
+		ProductID: productID,
+		Orgs:      orgs,
+		Reason:    reason,
+		SetBy:     mspID,
+		SetAt:     now,
+	}
+	overrideJSON, err := json.Marshal(override)
+	if err != nil {
+		return err
+	}
+	key, err := ctx.GetStub().CreateCompositeKey(endorsementOverrideObjectType, []string{productID})
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(key, overrideJSON); err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	return syncEndorsementPolicy(ctx, product)
+}
+
+// ResetProductEndorsementPolicy drops the override of the product's endorsement policy, so that
+// the owner's organization alone endorses its changes again.
+func (s *AdminContract) ResetProductEndorsementPolicy(ctx contractapi.TransactionContextInterface, productID string) error {
+	product, err := readProduct(ctx, productID)
+	if err != nil {
+		return err
+	}
+	if err := deleteEndorsementOverride(ctx, productID); err != nil {
+		return err
+	}
+	return syncEndorsementPolicy(ctx, product)
+}
+
+// syncEndorsementPolicy sets the product's key-level endorsement policy to its override, or to
+// the owner's organization. Ownership changes are validated against the previous policy, so a
+// transfer must be endorsed by the previous owner's peers.
+func syncEndorsementPolicy(ctx contractapi.TransactionContextInterface, product *Product) error {
+	orgs := []string{product.Owner}
+	override, err := readEndorsementOverride(ctx, product.ID)
+	if err != nil {
+		return err
+	}
+	if override != nil {
+		orgs = override.Orgs
+	} else if product.Owner == "" {
+		return nil
+	}
+
+	current, err := endorsingOrgs(ctx, product.ID)
+	if err != nil {
+		return err
+	}
+	if sameOrgs(current, orgs) {
+		return nil
+	}
+
+	policy, err := statebased.NewStateEP(nil)
+	if err != nil {
+		return err
+	}
+	if err := policy.AddOrgs(statebased.RoleTypePeer, orgs...); err != nil {
+		return err
+	}
+	policyBytes, err := policy.Policy()
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().SetStateValidationParameter(product.ID, policyBytes); err != nil {
+		return fmt.Errorf("Failed to set the endorsement policy of %s: %v", product.ID, err)
+	}
+	return nil
+}
+
+// endorsingOrgs lists the organizations of the key-level endorsement policy, sorted.
+func endorsingOrgs(ctx contractapi.TransactionContextInterface, key string) ([]string, error) {
+	policyBytes, err := ctx.GetStub().GetStateValidationParameter(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the endorsement policy of %s: %v", key, err)
+	}
+	if len(policyBytes) == 0 {
+		return []string{}, nil
+	}
+	policy, err := statebased.NewStateEP(policyBytes)
+	if err != nil {
+		return nil, err
+	}
+	orgs := policy.ListOrgs()
+	sort.Strings(orgs)
+	return orgs, nil
+}
+
+func sameOrgs(sorted []string, orgs []string) bool {
+	if len(sorted) != len(orgs) {
+		return false
+	}
+	other := append([]string(nil), orgs...)
+	sort.Strings(other)
+	for i := range sorted {
+		if sorted[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func readEndorsementOverride(ctx contractapi.TransactionContextInterface, productID string) (*EndorsementOverride, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(endorsementOverrideObjectType, []string{productID})
+	if err != nil {
+		return nil, err
+	}
+	overrideJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	if overrideJSON == nil {
+		return nil, nil
+	}
+
+	var override EndorsementOverride
+	err = json.Unmarshal(overrideJSON, &override)
+	if err != nil {
+		return nil, err
+	}
+	return &override, nil
+}
+
+func deleteEndorsementOverride(ctx contractapi.TransactionContextInterface, productID string) error {
+	key, err := ctx.GetStub().CreateCompositeKey(endorsementOverrideObjectType, []string{productID})
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().DelState(key)
+}
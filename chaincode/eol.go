@@ -0,0 +1,218 @@
+package chaincode
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// RecoveredMaterial is the mass of a material recovered when dismantling a product, in grams
+type RecoveredMaterial struct {
+	Material string  `json:"material"`
+	Mass     float64 `json:"mass"`
+}
+
+// EndOfLife records the release of a product to a recycler by its owner, and its collection,
+// dismantling and destruction by the recycler
+type EndOfLife struct {
+	Recycler                   string              `json:"recycler"`
+	PreviousOwner              string              `json:"previousOwner"`
+	ReleasedAt                 string              `json:"releasedAt,omitempty" metadata:"releasedAt,optional"`
+	CollectedAt                string              `json:"collectedAt,omitempty" metadata:"collectedAt,optional"`
+	DismantledAt               string              `json:"dismantledAt,omitempty" metadata:"dismantledAt,optional"`
+	RecoveredMaterials         []RecoveredMaterial `json:"recoveredMaterials,omitempty" metadata:"recoveredMaterials,optional"`
+	DestructionCertificateHash string              `json:"destructionCertificateHash,omitempty" metadata:"destructionCertificateHash,optional"`
+	DestroyedAt                string              `json:"destroyedAt,omitempty" metadata:"destroyedAt,optional"`
+}
+
+// ReleaseForRecycling hands the product over to the given recycler, which may then collect it.
+// Releasing it again names another recycler. The release lapses if the product changes hands
+// before it is collected.
+func (s *ProductContract) ReleaseForRecycling(ctx contractapi.TransactionContextInterface, id string, recycler string) error {
+	product, err := readProduct(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := assertOwner(ctx, product); err != nil {
+		return err
+	}
+	if err := assertCollectable(product); err != nil {
+		return err
+	}
+	ok, err := hasOrgRole(ctx, recycler, RoleRecycler)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("The organization %s is not a registered %s", recycler, RoleRecycler)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	product.EndOfLife = &EndOfLife{
+		Recycler:      recycler,
+		PreviousOwner: product.Owner,
+		ReleasedAt:    now,
+	}
+	product.UpdatedAt = now
+	return putProduct(ctx, product)
+}
+
+// CollectForRecycling takes the product its owner released to the calling recycler, and every
+// component installed in it, into the recycler's custody. From then on the product can no longer
+// be transferred or sold.
+func (s *ProductContract) CollectForRecycling(ctx contractapi.TransactionContextInterface, id string) error {
+	recycler, err := assertOrgRole(ctx, RoleRecycler)
+	if err != nil {
+		return err
+	}
+	product, err := readProduct(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := assertCollectable(product); err != nil {
+		return err
+	}
+	release := product.EndOfLife
+	if release == nil || release.Recycler != recycler || release.PreviousOwner != product.Owner {
+		return fmt.Errorf("The product %s has not been released to %s by its owner", id, recycler)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	return collectProduct(ctx, product, recycler, now)
+}
+
+// assertCollectable fails unless the product may enter recycling.
+func assertCollectable(product *Product) error {
+	switch {
+	case product.Stolen:
+		return fmt.Errorf("The product %s is reported stolen", product.ID)
+	case isEndOfLife(product.Status):
+		return fmt.Errorf("The product %s has reached end of life", product.ID)
+	case product.ParentID != "":
+		return fmt.Errorf("The product %s is installed in %s", product.ID, product.ParentID)
+	case product.ShipmentID != "":
+		return fmt.Errorf("The product %s is packed in %s", product.ID, product.ShipmentID)
+	}
+	return nil
+}
+
+// collectProduct puts the product and, recursively, its components in the recycler's custody and
+// records the receipt in their custody trails.
+// Components go along with the product they are installed in, without a release of their own.
+func collectProduct(ctx contractapi.TransactionContextInterface, product *Product, recycler string, now string) error {
+	if product.EndOfLife == nil {
+		product.EndOfLife = &EndOfLife{}
+	}
+	product.EndOfLife.Recycler = recycler
+	product.EndOfLife.PreviousOwner = product.Owner
+	product.EndOfLife.CollectedAt = now
+	product.Owner = recycler
+	product.Status = StatusCollectedForRecycling
+	product.UpdatedAt = now
+	if err := appendCustodyEvent(ctx, product.ID, CustodyReceive, "", nil); err != nil {
+		return err
+	}
+	if err := putProduct(ctx, product); err != nil {
+		return err
+	}
+
+	for _, componentID := range product.Components {
+		component, err := readProduct(ctx, componentID)
+		if err != nil {
+			return err
+		}
+		if err := collectProduct(ctx, component, recycler, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordDismantling records the materials recovered from a collected product. Installed
+// components are detached and stay collected, to be dismantled on their own.
+func (s *ProductContract) RecordDismantling(ctx contractapi.TransactionContextInterface, id string, recoveredMaterials []RecoveredMaterial) error {
+	product, err := recyclerProduct(ctx, id, StatusCollectedForRecycling)
+	if err != nil {
+		return err
+	}
+	for _, recovered := range recoveredMaterials {
+		if recovered.Material == "" || recovered.Mass <= 0 {
+			return fmt.Errorf("The recovered material %q needs a positive mass", recovered.Material)
+		}
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	product.Status = StatusDismantled
+	product.EndOfLife.DismantledAt = now
+	product.EndOfLife.RecoveredMaterials = recoveredMaterials
+	product.UpdatedAt = now
+	if err := appendCustodyEvent(ctx, product.ID, CustodyReceive, "", nil); err != nil {
+		return err
+	}
+	if err := putProduct(ctx, product); err != nil {
+		return err
+	}
+
+	for _, componentID := range append([]string(nil), product.Components...) {
+		if err := detachComponent(ctx, id, componentID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CertifyDestruction records the hash of the destruction certificate of a collected or
+// dismantled product, which is its final status.
+func (s *ProductContract) CertifyDestruction(ctx contractapi.TransactionContextInterface, id string, certificateHash string) error {
+	product, err := recyclerProduct(ctx, id, StatusCollectedForRecycling, StatusDismantled)
+	if err != nil {
+		return err
+	}
+	if len(product.Components) > 0 {
+		return fmt.Errorf("The product %s still has components attached and must be dismantled first", id)
+	}
+	certificateHash, err = normalizeSHA256(certificateHash)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	product.Status = StatusDestroyed
+	product.EndOfLife.DestructionCertificateHash = certificateHash
+	product.EndOfLife.DestroyedAt = now
+	product.UpdatedAt = now
+	return putProduct(ctx, product)
+}
+
+// recyclerProduct loads a product collected by the calling recycler and fails unless it is in
+// one of the given statuses.
+func recyclerProduct(ctx contractapi.TransactionContextInterface, id string, statuses ...int) (*Product, error) {
+	if _, err := assertOrgRole(ctx, RoleRecycler); err != nil {
+		return nil, err
+	}
+	product, err := readProduct(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := assertOwner(ctx, product); err != nil {
+		return nil, err
+	}
+	for _, status := range statuses {
+		if product.Status == status && product.EndOfLife != nil {
+			return product, nil
+		}
+	}
+	return nil, fmt.Errorf("The product %s cannot be processed in status %d", id, product.Status)
+}
@@ -0,0 +1,582 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// EPCIS event types
+const (
+	EPCISObjectEvent         = "ObjectEvent"
+	EPCISAggregationEvent    = "AggregationEvent"
+	EPCISTransformationEvent = "TransformationEvent"
+)
+
+const sgtinURNPrefix = "urn:epc:id:sgtin:"
+
+// epcisStep describes how a CBV business step changes the products an event refers to
+type epcisStep struct {
+	status       int
+	commission   bool
+	decommission bool
+	destroy      bool
+	receive      bool
+	assemble     bool
+	disassemble  bool
+}
+
+// epcisBizSteps maps the supported CBV business steps to their effect. Events with any other
+// business step are rejected, as are destroying events, since a destruction needs the
+// certificate that CertifyDestruction records.
+var epcisBizSteps = map[string]epcisStep{
+	"commissioning":    {commission: true},
+	"accepting":        {},
+	"arriving":         {receive: true},
+	"receiving":        {receive: true},
+	"storing":          {},
+	"stocking":         {},
+	"inspecting":       {},
+	"holding":          {},
+	"cycle_counting":   {},
+	"picking":          {},
+	"loading":          {},
+	"unloading":        {},
+	"staging_outbound": {},
+	"transporting":     {},
+	"repairing":        {},
+	"departing":        {status: StatusInTransit},
+	"shipping":         {status: StatusInTransit},
+	"packing":          {},
+	"unpacking":        {},
+	"assembling":       {assemble: true},
+	"installing":       {assemble: true},
+	"disassembling":    {disassemble: true},
+	"removing":         {disassemble: true},
+	"decommissioning":  {decommission: true},
+	"destroying":       {destroy: true},
+}
+
+// EPCISEventResult reports how one event of an ingested document was handled
+type EPCISEventResult struct {
+	Index      int      `json:"index"`
+	EventID    string   `json:"eventID,omitempty" metadata:"eventID,optional"`
+	Type       string   `json:"type"`
+	BizStep    string   `json:"bizStep,omitempty" metadata:"bizStep,optional"`
+	ProductIDs []string `json:"productIDs,omitempty" metadata:"productIDs,optional"`
+	Applied    bool     `json:"applied"`
+	Error      string   `json:"error,omitempty" metadata:"error,optional"`
+}
+
+// EPCISReport summarizes an IngestEPCISEvents call
+type EPCISReport struct {
+	Applied  int                 `json:"applied"`
+	Rejected int                 `json:"rejected"`
+	Events   []*EPCISEventResult `json:"events"`
+}
+
+type epcisDocument struct {
+	Type      string `json:"type"`
+	EPCISBody struct {
+		EventList []json.RawMessage `json:"eventList"`
+	} `json:"epcisBody"`
+}
+
+type epcisLocation struct {
+	ID string `json:"id"`
+}
+
+type epcisEvent struct {
+	Type          string         `json:"type"`
+	EventID       string         `json:"eventID"`
+	EventTime     string         `json:"eventTime"`
+	Action        string         `json:"action"`
+	BizStep       string         `json:"bizStep"`
+	EPCList       []string       `json:"epcList"`
+	ParentID      string         `json:"parentID"`
+	ChildEPCs     []string       `json:"childEPCs"`
+	InputEPCList  []string       `json:"inputEPCList"`
+	OutputEPCList []string       `json:"outputEPCList"`
+	ReadPoint     *epcisLocation `json:"readPoint"`
+	BizLocation   *epcisLocation `json:"bizLocation"`
+}
+
+// IngestEPCISEvents applies the ObjectEvents, AggregationEvents and TransformationEvents of a
+// GS1 EPCIS 2.0 JSON-LD document. SGTIN EPCs are resolved to product IDs, and each event's
+// business step drives the status, location and aggregation of the products owned by the caller.
+// Every event is applied on its own: a rejected event leaves no changes and is reported with
+// its error, while the other events still apply.
+func (s *ProductContract) IngestEPCISEvents(ctx contractapi.TransactionContextInterface, document string) (*EPCISReport, error) {
+	var doc epcisDocument
+	if err := json.Unmarshal([]byte(document), &doc); err != nil {
+		return nil, fmt.Errorf("Failed to parse EPCIS document: %v", err)
+	}
+	if doc.Type != "EPCISDocument" {
+		return nil, fmt.Errorf("Expected an EPCISDocument, got %q", doc.Type)
+	}
+
+	report := &EPCISReport{Events: []*EPCISEventResult{}}
+	for i, raw := range doc.EPCISBody.EventList {
+		result := &EPCISEventResult{Index: i}
+		report.Events = append(report.Events, result)
+
+		var event epcisEvent
+		if err := json.Unmarshal(raw, &event); err != nil {
+			result.Error = fmt.Sprintf("Malformed event: %v", err)
+			report.Rejected++
+			continue
+		}
+		result.EventID = event.EventID
+		result.Type = event.Type
+		result.BizStep = normalizeBizStep(event.BizStep)
+
+		staged := newStagedContext(ctx)
+		productIDs, err := applyEPCISEvent(staged, &event, result.BizStep)
+		if err == nil {
+			err = staged.commit()
+		}
+		if err != nil {
+			result.Error = err.Error()
+			report.Rejected++
+			continue
+		}
+		// writes made through the staged context are not tracked by ctx
+		for _, productID := range productIDs {
+			markProductChanged(ctx, productID)
+		}
+		result.ProductIDs = productIDs
+		result.Applied = true
+		report.Applied++
+	}
+
+	return report, nil
+}
+
+// applyEPCISEvent applies a single event and returns the IDs of the products it changed.
+func applyEPCISEvent(ctx contractapi.TransactionContextInterface, event *epcisEvent, bizStep string) ([]string, error) {
+	step, ok := epcisBizSteps[bizStep]
+	if !ok {
+		return nil, fmt.Errorf("Unknown business step %q", event.BizStep)
+	}
+	if step.destroy {
+		return nil, fmt.Errorf("The %s step is not applied from EPCIS events, record the destruction certificate with CertifyDestruction", bizStep)
+	}
+
+	var siteID string
+	if event.BizLocation != nil && event.BizLocation.ID != "" {
+		siteID = event.BizLocation.ID
+	} else if event.ReadPoint != nil && event.ReadPoint.ID != "" {
+		siteID = event.ReadPoint.ID
+	}
+	var location *Location
+	if siteID != "" {
+		mspID, err := clientMSPID(ctx)
+		if err != nil {
+			return nil, err
+		}
+		location = &Location{SiteID: siteID, Org: mspID}
+	}
+
+	switch event.Type {
+	case EPCISObjectEvent:
+		productIDs, err := resolveEPCs(ctx, event.EPCList)
+		if err != nil {
+			return nil, err
+		}
+		return productIDs, observeProducts(ctx, productIDs, step, location, event.EventTime)
+
+	case EPCISAggregationEvent:
+		return applyAggregation(ctx, event, step, location)
+
+	case EPCISTransformationEvent:
+		inputs, err := resolveEPCs(ctx, event.InputEPCList)
+		if err != nil {
+			return nil, err
+		}
+		outputs, err := resolveEPCs(ctx, event.OutputEPCList)
+		if err != nil {
+			return nil, err
+		}
+		if step.assemble || step.disassemble {
+			if len(outputs) != 1 {
+				return nil, fmt.Errorf("The %s step needs exactly one output product, got %d", bizStep, len(outputs))
+			}
+			for _, input := range inputs {
+				var err error
+				if step.assemble {
+					err = attachComponent(ctx, outputs[0], input)
+				} else {
+					err = detachComponent(ctx, outputs[0], input)
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		return append(inputs, outputs...), observeProducts(ctx, outputs, step, location, event.EventTime)
+	}
+
+	return nil, fmt.Errorf("Unsupported event type %q", event.Type)
+}
+
+// applyAggregation packs the child EPCs into, or unpacks them from, the container identified by the
+// event's parentID. Children may be products or previously packed containers.
+func applyAggregation(ctx contractapi.TransactionContextInterface, event *epcisEvent, step epcisStep, location *Location) ([]string, error) {
+	if event.ParentID == "" {
+		return nil, fmt.Errorf("The AggregationEvent has no parentID")
+	}
+
+	var productIDs, childIDs []string
+	for _, epc := range event.ChildEPCs {
+		child, err := readShipment(ctx, epc)
+		if err != nil {
+			return nil, err
+		}
+		if child != nil {
+			childIDs = append(childIDs, epc)
+			continue
+		}
+		productID, err := resolveEPC(ctx, epc)
+		if err != nil {
+			return nil, err
+		}
+		productIDs = append(productIDs, productID)
+	}
+
+	switch {
+	case event.Action == "ADD":
+		container, err := readShipment(ctx, event.ParentID)
+		if err != nil {
+			return nil, err
+		}
+		if container == nil {
+			from, err := clientMSPID(ctx)
+			if err != nil {
+				return nil, err
+			}
+			now, err := txTimestamp(ctx)
+			if err != nil {
+				return nil, err
+			}
+			kind := KindCarton
+			if strings.HasPrefix(event.ParentID, "urn:epc:id:sscc:") {
+				kind = KindPallet
+			}
+			container = &Shipment{ID: event.ParentID, Kind: kind, State: ShipmentPacked, From: from, PackedAt: now}
+		} else if err := assertPackable(ctx, container); err != nil {
+			return nil, err
+		}
+		for _, productID := range productIDs {
+			if err := packProduct(ctx, container, productID); err != nil {
+				return nil, err
+			}
+		}
+		for _, childID := range childIDs {
+			if err := packChild(ctx, container, childID); err != nil {
+				return nil, err
+			}
+		}
+		if err := putShipment(ctx, container); err != nil {
+			return nil, err
+		}
+
+	case event.Action == "DELETE":
+		container, err := readShipment(ctx, event.ParentID)
+		if err != nil {
+			return nil, err
+		}
+		if container == nil {
+			return nil, fmt.Errorf("The shipment %s does not exist", event.ParentID)
+		}
+		if err := assertPackable(ctx, container); err != nil {
+			return nil, err
+		}
+		if len(event.ChildEPCs) == 0 {
+			productIDs, childIDs = container.ProductIDs, container.ChildIDs
+		}
+		if err := unpackShipment(ctx, container, productIDs, childIDs); err != nil {
+			return nil, err
+		}
+	}
+
+	return productIDs, observeProducts(ctx, productIDs, step, location, event.EventTime)
+}
+
+// observeProducts applies the status and location of an event to products owned by the caller.
+// Status changes are subject to the configured transitions.
+func observeProducts(ctx contractapi.TransactionContextInterface, productIDs []string, step epcisStep, location *Location, eventTime string) error {
+	for _, productID := range productIDs {
+		product, err := readProduct(ctx, productID)
+		if err != nil {
+			return err
+		}
+		if err := assertOwner(ctx, product); err != nil {
+			return err
+		}
+
+		status, err := observedStatus(ctx, product, step)
+		if err != nil {
+			return err
+		}
+		if err := validateStatusTransition(ctx, product.Status, status); err != nil {
+			return err
+		}
+		product.Status = status
+		if location != nil {
+			product.Location = location
+		}
+		if eventTime != "" {
+			product.UpdatedAt = eventTime
+		}
+
+		if err := putProduct(ctx, product); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// observedStatus returns the status the business step moves the product to. Products only enter
+// recycling through the recycler flow, and packed products only change status with their shipment.
+func observedStatus(ctx contractapi.TransactionContextInterface, product *Product, step epcisStep) (int, error) {
+	switch {
+	case step.commission:
+		if product.Status != StatusRegistered || product.SoldAt != "" {
+			return 0, fmt.Errorf("The product %s was commissioned before and is in status %d", product.ID, product.Status)
+		}
+		return StatusRegistered, nil
+
+	case step.decommission:
+		if err := assertCollectable(product); err != nil {
+			return 0, err
+		}
+		return StatusScrapped, nil
+
+	case step.status != 0 || step.receive && product.Status == StatusInTransit:
+		if isEndOfLife(product.Status) {
+			return 0, fmt.Errorf("The product %s has reached end of life", product.ID)
+		}
+		if product.ShipmentID != "" {
+			return 0, fmt.Errorf("The product %s is packed in %s and changes status with the shipment", product.ID, product.ShipmentID)
+		}
+		if step.status != 0 {
+			return step.status, nil
+		}
+		if product.Condition == ConditionRefurbished {
+			return StatusRefurbished, nil
+		}
+		return StatusRegistered, nil
+	}
+	return product.Status, nil
+}
+
+// assertPackable fails unless the container is still being packed by the caller.
+func assertPackable(ctx contractapi.TransactionContextInterface, container *Shipment) error {
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	if container.From != mspID || container.State != ShipmentPacked {
+		return fmt.Errorf("The shipment %s is not being packed by %s", container.ID, mspID)
+	}
+	return nil
+}
+
+// unpackShipment removes products and nested containers from a packed container and writes it.
+func unpackShipment(ctx contractapi.TransactionContextInterface, container *Shipment, productIDs []string, childIDs []string) error {
+	for _, productID := range productIDs {
+		if !containsString(container.ProductIDs, productID) {
+			return fmt.Errorf("The product %s is not packed in %s", productID, container.ID)
+		}
+		product, err := readProduct(ctx, productID)
+		if err != nil {
+			return err
+		}
+		product.ShipmentID = ""
+		if err := putProduct(ctx, product); err != nil {
+			return err
+		}
+	}
+	for _, childID := range childIDs {
+		if !containsString(container.ChildIDs, childID) {
+			return fmt.Errorf("The shipment %s is not packed in %s", childID, container.ID)
+		}
+		child, err := readShipment(ctx, childID)
+		if err != nil {
+			return err
+		}
+		child.ParentID = ""
+		if err := putShipment(ctx, child); err != nil {
+			return err
+		}
+	}
+
+	container.ProductIDs = removeStrings(container.ProductIDs, productIDs)
+	container.ChildIDs = removeStrings(container.ChildIDs, childIDs)
+	return putShipment(ctx, container)
+}
+
+// resolveEPCs maps every EPC to the ID of the product it identifies.
+func resolveEPCs(ctx contractapi.TransactionContextInterface, epcs []string) ([]string, error) {
+	var productIDs []string
+	for _, epc := range epcs {
+		productID, err := resolveEPC(ctx, epc)
+		if err != nil {
+			return nil, err
+		}
+		productIDs = append(productIDs, productID)
+	}
+	return productIDs, nil
+}
+
+// resolveEPC maps an SGTIN EPC URN to a product, first through the SGTIN index and otherwise to
+// the product whose ID is the SGTIN serial number.
+func resolveEPC(ctx contractapi.TransactionContextInterface, epc string) (string, error) {
+	if !strings.HasPrefix(epc, sgtinURNPrefix) {
+		return "", fmt.Errorf("Unsupported EPC %s", epc)
+	}
+	sgtin, err := parseSGTIN(epc)
+	if err != nil {
+		return "", err
+	}
+
+	productID, err := productIDBySGTIN(ctx, sgtin)
+	if err != nil {
+		return "", err
+	}
+	if productID != "" {
+		return productID, nil
+	}
+
+	exists, err := productExists(ctx, sgtin.Serial)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", fmt.Errorf("No product for EPC %s", epc)
+	}
+	return sgtin.Serial, nil
+}
+
+// normalizeBizStep strips the CBV URN or web vocabulary prefix from a business step.
+func normalizeBizStep(bizStep string) string {
+	bizStep = strings.TrimPrefix(bizStep, "urn:epcglobal:cbv:bizstep:")
+	bizStep = strings.TrimPrefix(bizStep, "https://ref.gs1.org/cbv/BizStep-")
+	return bizStep
+}
+
+func removeStrings(values []string, remove []string) []string {
+	kept := []string{}
+	for _, v := range values {
+		if !containsString(remove, v) {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// stagedStub buffers state writes so that a failed EPCIS event can be discarded without
+// leaving partial changes in the transaction's write set.
+type stagedStub struct {
+	shim.ChaincodeStubInterface
+	writes   map[string][]byte
+	order    []string
+	policies map[string][]byte
+}
+
+func (s *stagedStub) GetState(key string) ([]byte, error) {
+	if value, ok := s.writes[key]; ok {
+		return value, nil
+	}
+	return s.ChaincodeStubInterface.GetState(key)
+}
+
+func (s *stagedStub) PutState(key string, value []byte) error {
+	if _, ok := s.writes[key]; !ok {
+		s.order = append(s.order, key)
+	}
+	s.writes[key] = value
+	return nil
+}
+
+func (s *stagedStub) DelState(key string) error {
+	return s.PutState(key, nil)
+}
+
+func (s *stagedStub) GetStateValidationParameter(key string) ([]byte, error) {
+	if policy, ok := s.policies[key]; ok {
+		return policy, nil
+	}
+	return s.ChaincodeStubInterface.GetStateValidationParameter(key)
+}
+
+func (s *stagedStub) SetStateValidationParameter(key string, policy []byte) error {
+	if s.policies == nil {
+		s.policies = map[string][]byte{}
+	}
+	s.policies[key] = policy
+	return nil
+}
+
+// commit writes the buffered changes to the underlying stub in the order they were made.
+func (s *stagedStub) commit() error {
+	for _, key := range s.order {
+		var err error
+		if value := s.writes[key]; value == nil {
+			err = s.ChaincodeStubInterface.DelState(key)
+		} else {
+			err = s.ChaincodeStubInterface.PutState(key, value)
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to put to world state. %v", err)
+		}
+	}
+	for _, key := range sortedKeys(s.policies) {
+		if err := s.ChaincodeStubInterface.SetStateValidationParameter(key, s.policies[key]); err != nil {
+			return fmt.Errorf("Failed to set the endorsement policy of %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string][]byte) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// stagedContext is a transaction context whose stub buffers writes, along with the product
+// stats they change
+type stagedContext struct {
+	contractapi.TransactionContextInterface
+	stub  *stagedStub
+	stats *pendingStats
+}
+
+func newStagedContext(ctx contractapi.TransactionContextInterface) *stagedContext {
+	return &stagedContext{
+		TransactionContextInterface: ctx,
+		stub:                        &stagedStub{ChaincodeStubInterface: ctx.GetStub(), writes: map[string][]byte{}},
+		stats:                       pendingStatsOf(ctx).clone(),
+	}
+}
+
+// commit writes the buffered changes and hands the product stats back to the wrapped context.
+func (c *stagedContext) commit() error {
+	if err := c.stub.commit(); err != nil {
+		return err
+	}
+	*pendingStatsOf(c.TransactionContextInterface) = *c.stats
+	return nil
+}
+
+func (c *stagedContext) GetStub() shim.ChaincodeStubInterface {
+	return c.stub
+}
@@ -0,0 +1,299 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	firmwareObjectType       = "firmware"
+	firmwareUpdateObjectType = "firmwareUpdate"
+)
+
+// FirmwareRelease is a published firmware version and the models it may be installed on
+type FirmwareRelease struct {
+	Version      string   `json:"version"`
+	ModelIDs     []string `json:"modelIDs"`
+	ArtifactHash string   `json:"artifactHash"`
+	Publisher    string   `json:"publisher"`
+	ReleasedAt   string   `json:"releasedAt"`
+}
+
+// FirmwareUpdate records one firmware installation on a product
+type FirmwareUpdate struct {
+	ProductID   string `json:"productID"`
+	FromVersion string `json:"fromVersion,omitempty" metadata:"fromVersion,optional"`
+	ToVersion   string `json:"toVersion"`
+	Overridden  bool   `json:"overridden,omitempty" metadata:"overridden,optional"`
+	UpdatedBy   string `json:"updatedBy"`
+	UpdatedAt   string `json:"updatedAt"`
+	TxID        string `json:"txID"`
+}
+
+// AddFirmwareRelease registers a firmware version, compatible with the given models, on the ledger.
+func (s *AdminContract) AddFirmwareRelease(ctx contractapi.TransactionContextInterface, version string, modelIDs []string, artifactHash string) error {
+	if version == "" || len(modelIDs) == 0 || artifactHash == "" {
+		return fmt.Errorf("A firmware release needs a version, at least one model and an artifact hash")
+	}
+
+	existing, err := readFirmwareRelease(ctx, version)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("The firmware %s already exists", version)
+	}
+
+	publisher, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	releasedAt, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	release := FirmwareRelease{
+		Version:      version,
+		ModelIDs:     modelIDs,
+		ArtifactHash: artifactHash,
+		Publisher:    publisher,
+		ReleasedAt:   releasedAt,
+	}
+	releaseJSON, err := json.Marshal(release)
+	if err != nil {
+		return err
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(firmwareObjectType, []string{version})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(key, releaseJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	return nil
+}
+
+// QueryFirmwareRelease returns the firmware release with given version.
+func (s *QueryContract) QueryFirmwareRelease(ctx contractapi.TransactionContextInterface, version string) (*FirmwareRelease, error) {
+	return queryFirmwareRelease(ctx, version)
+}
+
+// queryFirmwareRelease returns the firmware release with given version, failing when it does not exist.
+func queryFirmwareRelease(ctx contractapi.TransactionContextInterface, version string) (*FirmwareRelease, error) {
+	release, err := readFirmwareRelease(ctx, version)
+	if err != nil {
+		return nil, err
+	}
+	if release == nil {
+		return nil, fmt.Errorf("The firmware %s does not exist", version)
+	}
+	return release, nil
+}
+
+// RecordFirmwareUpdate installs the firmware version on the product. Incompatible versions and
+// downgrades are rejected unless allowOverride is set by an admin. Only the owner or a refurbisher
+// servicing the product may update it, and never once it is scrapped or has reached end of life.
+func (s *ProductContract) RecordFirmwareUpdate(ctx contractapi.TransactionContextInterface, productID string, version string, allowOverride bool) error {
+	product, err := readProduct(ctx, productID)
+	if err != nil {
+		return err
+	}
+	updatedBy, err := assertServiceOrg(ctx, product)
+	if err != nil {
+		return err
+	}
+	if product.Status == StatusScrapped || isEndOfLife(product.Status) {
+		return fmt.Errorf("The product %s has reached end of life", productID)
+	}
+	release, err := queryFirmwareRelease(ctx, version)
+	if err != nil {
+		return err
+	}
+
+	var violation string
+	if !containsString(release.ModelIDs, product.ModelID) {
+		violation = fmt.Sprintf("The firmware %s is not compatible with model %s", version, product.ModelID)
+	} else if product.Firmware != "" && compareVersions(version, product.Firmware) < 0 {
+		violation = fmt.Sprintf("The firmware %s is older than the installed %s", version, product.Firmware)
+	}
+	if violation != "" {
+		if !allowOverride {
+			return errors.New(violation)
+		}
+		if err := assertAdmin(ctx); err != nil {
+			return err
+		}
+	}
+
+	updatedAt, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	update := FirmwareUpdate{
+		ProductID:   productID,
+		FromVersion: product.Firmware,
+		ToVersion:   version,
+		Overridden:  violation != "",
+		UpdatedBy:   updatedBy,
+		UpdatedAt:   updatedAt,
+		TxID:        ctx.GetStub().GetTxID(),
+	}
+	updateJSON, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+
+	// keys sort by timestamp, so a range over the product prefix yields the timeline in order
+	key, err := ctx.GetStub().CreateCompositeKey(firmwareUpdateObjectType, []string{productID, updatedAt, update.TxID})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(key, updateJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+
+	product.Firmware = version
+	return putProduct(ctx, product)
+}
+
+// QueryCurrentFirmware returns the firmware release currently installed on the product.
+func (s *QueryContract) QueryCurrentFirmware(ctx contractapi.TransactionContextInterface, productID string) (*FirmwareRelease, error) {
+	product, err := readProduct(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	if product.Firmware == "" {
+		return nil, fmt.Errorf("The product %s has no recorded firmware", productID)
+	}
+	return s.QueryFirmwareRelease(ctx, product.Firmware)
+}
+
+// QueryFirmwareTimeline returns every firmware update of the product, oldest first.
+func (s *QueryContract) QueryFirmwareTimeline(ctx contractapi.TransactionContextInterface, productID string) ([]*FirmwareUpdate, error) {
+	return firmwareTimeline(ctx, productID)
+}
+
+// firmwareTimeline returns the firmware updates of the product, oldest first.
+func firmwareTimeline(ctx contractapi.TransactionContextInterface, productID string) ([]*FirmwareUpdate, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(firmwareUpdateObjectType, []string{productID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var updates []*FirmwareUpdate
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var update FirmwareUpdate
+		err = json.Unmarshal(queryResponse.Value, &update)
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, &update)
+	}
+
+	return updates, nil
+}
+
+// QueryFirmwareAt returns the firmware version the product ran at the given time. A plain date
+// (YYYY-MM-DD) covers the whole day.
+func (s *QueryContract) QueryFirmwareAt(ctx contractapi.TransactionContextInterface, productID string, at string) (string, error) {
+	if len(at) == len("2006-01-02") {
+		at += "T23:59:59Z"
+	}
+
+	updates, err := s.QueryFirmwareTimeline(ctx, productID)
+	if err != nil {
+		return "", err
+	}
+
+	version := ""
+	for _, update := range updates {
+		if update.UpdatedAt > at {
+			break
+		}
+		version = update.ToVersion
+	}
+	if version == "" {
+		return "", fmt.Errorf("The product %s has no recorded firmware at %s", productID, at)
+	}
+	return version, nil
+}
+
+// readFirmwareRelease returns the firmware release with given version, or nil if none exists.
+func readFirmwareRelease(ctx contractapi.TransactionContextInterface, version string) (*FirmwareRelease, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(firmwareObjectType, []string{version})
+	if err != nil {
+		return nil, err
+	}
+	releaseJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	if releaseJSON == nil {
+		return nil, nil
+	}
+
+	var release FirmwareRelease
+	err = json.Unmarshal(releaseJSON, &release)
+	if err != nil {
+		return nil, err
+	}
+	return &release, nil
+}
+
+// compareVersions compares dotted version strings segment by segment, numerically where both
+// segments are numbers. It returns -1, 0 or 1.
+func compareVersions(a string, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := "0", "0"
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+
+		xn, xerr := strconv.Atoi(x)
+		yn, yerr := strconv.Atoi(y)
+		switch {
+		case xerr == nil && yerr == nil && xn != yn:
+			if xn < yn {
+				return -1
+			}
+			return 1
+		case (xerr != nil || yerr != nil) && x != y:
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
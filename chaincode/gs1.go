@@ -0,0 +1,286 @@
+package chaincode
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	sgtinObjectType = "sgtin"
+
+	digitalLinkPrefix = "https://id.gs1.org"
+)
+
+// SGTIN is a GS1 serialized global trade item number. The company prefix length is only known
+// when the SGTIN was given as an EPC URN and is needed to render one.
+type SGTIN struct {
+	GTIN                string `json:"gtin"`
+	Serial              string `json:"serial"`
+	CompanyPrefixLength int    `json:"companyPrefixLength,omitempty" metadata:"companyPrefixLength,optional"`
+}
+
+// GS1Identifiers lists the equivalent identifiers of a serialized product
+type GS1Identifiers struct {
+	ProductID     string `json:"productID"`
+	GTIN          string `json:"gtin"`
+	Serial        string `json:"serial"`
+	ElementString string `json:"elementString"`
+	DigitalLink   string `json:"digitalLink"`
+	EPCURN        string `json:"epcURN,omitempty" metadata:"epcURN,optional"`
+}
+
+// SetProductSGTIN assigns a serialized GTIN to the product. The identifier may be an EPC URN,
+// a GS1 Digital Link URI or an element string such as (01)09506000134352(21)ABC123. When the
+// product's model carries a GTIN, the SGTIN must use it.
+func (s *ProductContract) SetProductSGTIN(ctx contractapi.TransactionContextInterface, id string, identifier string) error {
+	sgtin, err := parseSGTIN(identifier)
+	if err != nil {
+		return err
+	}
+	product, err := readProduct(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := assertOwner(ctx, product); err != nil {
+		return err
+	}
+
+	model, err := readModel(ctx, product.ModelID)
+	if err != nil {
+		return err
+	}
+	if model != nil && model.GTIN != "" && model.GTIN != sgtin.GTIN {
+		return fmt.Errorf("The GTIN %s does not match %s of model %s", sgtin.GTIN, model.GTIN, model.ID)
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(sgtinObjectType, []string{sgtin.GTIN, sgtin.Serial})
+	if err != nil {
+		return err
+	}
+	owner, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	if owner != nil && string(owner) != id {
+		return fmt.Errorf("The SGTIN %s is already assigned to %s", sgtin.elementString(), owner)
+	}
+
+	if product.SGTIN != nil {
+		oldKey, err := ctx.GetStub().CreateCompositeKey(sgtinObjectType, []string{product.SGTIN.GTIN, product.SGTIN.Serial})
+		if err != nil {
+			return err
+		}
+		if err := ctx.GetStub().DelState(oldKey); err != nil {
+			return err
+		}
+	}
+	if err := ctx.GetStub().PutState(key, []byte(id)); err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+
+	product.SGTIN = sgtin
+	return putProduct(ctx, product)
+}
+
+// QueryProductByGS1 returns the product identified by an EPC URN, a GS1 Digital Link URI, an
+// element string or its internal ID.
+func (s *QueryContract) QueryProductByGS1(ctx contractapi.TransactionContextInterface, identifier string) (*Product, error) {
+	sgtin, err := parseSGTIN(identifier)
+	if err != nil {
+		exists, existsErr := productExists(ctx, identifier)
+		if existsErr != nil {
+			return nil, existsErr
+		}
+		if !exists {
+			return nil, err
+		}
+		return readProduct(ctx, identifier)
+	}
+
+	productID, err := productIDBySGTIN(ctx, sgtin)
+	if err != nil {
+		return nil, err
+	}
+	if productID == "" {
+		return nil, fmt.Errorf("No product has the SGTIN %s", sgtin.elementString())
+	}
+	return readProduct(ctx, productID)
+}
+
+// QueryGS1Identifiers converts any identifier accepted by QueryProductByGS1 into all the others.
+func (s *QueryContract) QueryGS1Identifiers(ctx contractapi.TransactionContextInterface, identifier string) (*GS1Identifiers, error) {
+	product, err := s.QueryProductByGS1(ctx, identifier)
+	if err != nil {
+		return nil, err
+	}
+	if product.SGTIN == nil {
+		return nil, fmt.Errorf("The product %s has no SGTIN", product.ID)
+	}
+
+	sgtin := product.SGTIN
+	return &GS1Identifiers{
+		ProductID:     product.ID,
+		GTIN:          sgtin.GTIN,
+		Serial:        sgtin.Serial,
+		ElementString: sgtin.elementString(),
+		DigitalLink:   sgtin.digitalLink(),
+		EPCURN:        sgtin.epcURN(),
+	}, nil
+}
+
+// productIDBySGTIN looks the SGTIN up in the uniqueness index and returns "" when it is unassigned.
+func productIDBySGTIN(ctx contractapi.TransactionContextInterface, sgtin *SGTIN) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(sgtinObjectType, []string{sgtin.GTIN, sgtin.Serial})
+	if err != nil {
+		return "", err
+	}
+	productID, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	return string(productID), nil
+}
+
+// parseSGTIN reads an SGTIN from an EPC URN, a GS1 Digital Link URI or a bracketed element string.
+func parseSGTIN(identifier string) (*SGTIN, error) {
+	var sgtin SGTIN
+
+	switch {
+	case strings.HasPrefix(identifier, sgtinURNPrefix):
+		parts := strings.Split(strings.TrimPrefix(identifier, sgtinURNPrefix), ".")
+		if len(parts) != 3 || len(parts[0])+len(parts[1]) != 13 || len(parts[0]) < 6 || len(parts[1]) < 1 {
+			return nil, fmt.Errorf("Malformed SGTIN %s", identifier)
+		}
+		if !isDigits(parts[0]) || !isDigits(parts[1]) {
+			return nil, fmt.Errorf("Malformed SGTIN %s", identifier)
+		}
+		serial, err := url.PathUnescape(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("Malformed SGTIN %s: %v", identifier, err)
+		}
+		gtin := parts[1][:1] + parts[0] + parts[1][1:]
+		sgtin = SGTIN{GTIN: gtin + strconv.Itoa(gtinCheckDigit(gtin)), Serial: serial, CompanyPrefixLength: len(parts[0])}
+
+	case strings.HasPrefix(identifier, "http://") || strings.HasPrefix(identifier, "https://"):
+		u, err := url.Parse(identifier)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed Digital Link %s: %v", identifier, err)
+		}
+		segments := strings.Split(u.EscapedPath(), "/")
+		for i := 0; i+1 < len(segments); i++ {
+			value, err := url.PathUnescape(segments[i+1])
+			if err != nil {
+				return nil, fmt.Errorf("Malformed Digital Link %s: %v", identifier, err)
+			}
+			switch segments[i] {
+			case "01":
+				sgtin.GTIN = value
+			case "21":
+				sgtin.Serial = value
+			}
+		}
+		if sgtin.GTIN == "" || sgtin.Serial == "" {
+			return nil, fmt.Errorf("The Digital Link %s has no GTIN (01) and serial (21)", identifier)
+		}
+
+	case strings.HasPrefix(identifier, "(01)"):
+		rest := strings.TrimPrefix(identifier, "(01)")
+		i := strings.Index(rest, "(21)")
+		if i < 0 {
+			return nil, fmt.Errorf("The element string %s has no serial (21)", identifier)
+		}
+		sgtin = SGTIN{GTIN: rest[:i], Serial: rest[i+len("(21)"):]}
+
+	default:
+		return nil, fmt.Errorf("The identifier %s is not an EPC URN, Digital Link or element string", identifier)
+	}
+
+	gtin, err := normalizeGTIN(sgtin.GTIN)
+	if err != nil {
+		return nil, err
+	}
+	sgtin.GTIN = gtin
+	if err := validateSerial(sgtin.Serial); err != nil {
+		return nil, err
+	}
+	return &sgtin, nil
+}
+
+// normalizeGTIN validates the check digit of a GTIN-8, -12, -13 or -14 and pads it to 14 digits.
+func normalizeGTIN(gtin string) (string, error) {
+	switch len(gtin) {
+	case 8, 12, 13, 14:
+	default:
+		return "", fmt.Errorf("The GTIN %s must have 8, 12, 13 or 14 digits", gtin)
+	}
+	if !isDigits(gtin) {
+		return "", fmt.Errorf("The GTIN %s must only contain digits", gtin)
+	}
+
+	gtin = strings.Repeat("0", 14-len(gtin)) + gtin
+	if check := gtinCheckDigit(gtin[:13]); int(gtin[13]-'0') != check {
+		return "", fmt.Errorf("The GTIN %s has an invalid check digit, expected %d", gtin, check)
+	}
+	return gtin, nil
+}
+
+// gtinCheckDigit computes the GS1 mod-10 check digit for the given digits.
+func gtinCheckDigit(digits string) int {
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		// weights alternate 3, 1, 3, ... starting from the rightmost digit
+		if (len(digits)-1-i)%2 == 0 {
+			d *= 3
+		}
+		sum += d
+	}
+	return (10 - sum%10) % 10
+}
+
+// validateSerial checks a serial against GS1 application identifier 21: up to 20 characters of
+// the GS1 AI encodable character set 82.
+func validateSerial(serial string) error {
+	if serial == "" || len(serial) > 20 {
+		return fmt.Errorf("The serial %q must have 1 to 20 characters", serial)
+	}
+	for _, c := range serial {
+		if c < '!' || c > 'z' || strings.ContainsRune("#$@[\\]^`", c) {
+			return fmt.Errorf("The serial %q contains the invalid character %q", serial, c)
+		}
+	}
+	return nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func (s *SGTIN) elementString() string {
+	return "(01)" + s.GTIN + "(21)" + s.Serial
+}
+
+func (s *SGTIN) digitalLink() string {
+	return digitalLinkPrefix + "/01/" + s.GTIN + "/21/" + url.PathEscape(s.Serial)
+}
+
+// epcURN renders the SGTIN as an EPC pure identity URN, or "" when the company prefix length is unknown.
+func (s *SGTIN) epcURN() string {
+	if s.CompanyPrefixLength == 0 {
+		return ""
+	}
+	companyPrefix := s.GTIN[1 : 1+s.CompanyPrefixLength]
+	itemReference := s.GTIN[:1] + s.GTIN[1+s.CompanyPrefixLength:13]
+
+	serial := url.PathEscape(s.Serial)
+	return sgtinURNPrefix + companyPrefix + "." + itemReference + "." + serial
+}
@@ -0,0 +1,81 @@
+package chaincode
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// clientMSPID returns the MSP ID of the organization submitting the transaction.
+func clientMSPID(ctx contractapi.TransactionContextInterface) (string, error) {
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get client MSP ID: %v", err)
+	}
+	return mspID, nil
+}
+
+// clientID returns the unique ID of the identity submitting the transaction.
+func clientID(ctx contractapi.TransactionContextInterface) (string, error) {
+	id, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get client identity: %v", err)
+	}
+	return id, nil
+}
+
+// clientSubject returns the distinguished name of the certificate submitting the transaction.
+func clientSubject(ctx contractapi.TransactionContextInterface) (string, error) {
+	cert, err := ctx.GetClientIdentity().GetX509Certificate()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get client certificate: %v", err)
+	}
+	if cert == nil {
+		return "", fmt.Errorf("The client identity has no X.509 certificate")
+	}
+	return cert.Subject.String(), nil
+}
+
+// assertOwner fails unless the submitting organization owns the product.
+func assertOwner(ctx contractapi.TransactionContextInterface, product *Product) error {
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	if product.Owner != mspID {
+		return fmt.Errorf("The product %s is not owned by %s", product.ID, mspID)
+	}
+	return nil
+}
+
+// txTime returns the transaction timestamp, which is the same on every endorsing peer.
+func txTime(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	ts, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Failed to get transaction timestamp: %v", err)
+	}
+	t, err := ptypes.Timestamp(ts)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.UTC(), nil
+}
+
+// txTimestamp returns the transaction timestamp formatted as RFC 3339.
+func txTimestamp(ctx contractapi.TransactionContextInterface) (string, error) {
+	t, err := txTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	return t.Format(time.RFC3339), nil
+}
+
+// assertAdmin fails unless the submitting identity carries the role=admin certificate attribute.
+func assertAdmin(ctx contractapi.TransactionContextInterface) error {
+	if err := ctx.GetClientIdentity().AssertAttributeValue("role", "admin"); err != nil {
+		return fmt.Errorf("The caller is not an admin: %v", err)
+	}
+	return nil
+}
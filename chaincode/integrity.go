@@ -0,0 +1,497 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const quarantineObjectType = "quarantine"
+
+// Integrity issue kinds
+const (
+	IssueMalformed         = "malformed"
+	IssueMissingField      = "missingField"
+	IssueKeyMismatch       = "keyMismatch"
+	IssueOrphanedIndex     = "orphanedIndex"
+	IssueUnknownModel      = "unknownModel"
+	IssueDanglingReference = "danglingReference"
+)
+
+// Repair actions
+const (
+	RepairNone        = "none"
+	RepairFixed       = "fixed"
+	RepairQuarantined = "quarantined"
+)
+
+// integritySections are checked in order: product records, then the indexes that point at
+// products or models. A bookmark names the section it continues.
+var integritySections = []string{"products", sgtinObjectType, modelGTINObjectType, pairingObjectType}
+
+// requiredProductFields are the fields a product record must carry
+var requiredProductFields = []string{"ID", "modelID", "modelName", "make", "status", "updatedAt", "description"}
+
+// quarantinedIssues are the issues that make a record unreadable as a product
+var quarantinedIssues = map[string]bool{IssueMalformed: true, IssueMissingField: true, IssueKeyMismatch: true}
+
+// IntegrityIssue is a problem found with the record stored under Key. Fixable issues are
+// repaired in place and records that cannot be read as a product are quarantined. The other
+// issues, such as a reference to an unregistered model, are only reported.
+type IntegrityIssue struct {
+	Key     string `json:"key"`
+	Kind    string `json:"kind"`
+	Detail  string `json:"detail"`
+	Fixable bool   `json:"fixable"`
+}
+
+// IntegrityReport is one page of an integrity check
+type IntegrityReport struct {
+	Scanned  int               `json:"scanned"`
+	Issues   []*IntegrityIssue `json:"issues"`
+	Bookmark string            `json:"bookmark,omitempty" metadata:"bookmark,optional"`
+	Done     bool              `json:"done"`
+}
+
+// RepairResult is what RepairIntegrity did with a record
+type RepairResult struct {
+	Key    string            `json:"key"`
+	Action string            `json:"action"`
+	Issues []*IntegrityIssue `json:"issues"`
+}
+
+// QuarantinedRecord is a record RepairIntegrity moved out of the product namespace
+type QuarantinedRecord struct {
+	Key           string            `json:"key"`
+	Value         string            `json:"value"`
+	Issues        []*IntegrityIssue `json:"issues"`
+	QuarantinedAt string            `json:"quarantinedAt"`
+	TxID          string            `json:"txID"`
+}
+
+// CheckIntegrity checks up to pageSize records, continuing from the bookmark of the previous page,
+// and reports malformed product records, product records missing required fields or stored under
+// another product's key, references to unknown models or missing products and shipments, and
+// index entries that no longer match the record they point at. Pass the returned bookmark until
+// the report is done.
+func (s *AdminContract) CheckIntegrity(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*IntegrityReport, error) {
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("The page size must be positive")
+	}
+	section, pageBookmark := integritySections[0], ""
+	if bookmark != "" {
+		i := strings.Index(bookmark, "|")
+		if i < 0 {
+			return nil, fmt.Errorf("Malformed bookmark %q", bookmark)
+		}
+		section, pageBookmark = bookmark[:i], bookmark[i+1:]
+	}
+	next := -1
+	for i, name := range integritySections {
+		if name == section {
+			next = i + 1
+		}
+	}
+	if next < 0 {
+		return nil, fmt.Errorf("Malformed bookmark %q", bookmark)
+	}
+
+	report := &IntegrityReport{Issues: []*IntegrityIssue{}}
+	var err error
+	if section == integritySections[0] {
+		pageBookmark, err = checkProductPage(ctx, report, pageSize, pageBookmark)
+	} else {
+		pageBookmark, err = checkIndexPage(ctx, report, section, pageSize, pageBookmark)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case pageBookmark != "":
+		report.Bookmark = section + "|" + pageBookmark
+	case next < len(integritySections):
+		report.Bookmark = integritySections[next] + "|"
+	default:
+		report.Done = true
+	}
+	return report, nil
+}
+
+// RepairIntegrity checks the records stored under the given keys again and repairs them: orphaned
+// index entries are deleted and references to missing products and shipments are cleared.
+// Records that cannot be read as a product are moved to quarantine along with their index,
+// pairing and endorsement keys. Unknown models are left for the manufacturer to register.
+func (s *AdminContract) RepairIntegrity(ctx contractapi.TransactionContextInterface, keys []string) ([]*RepairResult, error) {
+	results := []*RepairResult{}
+	for _, key := range keys {
+		value, err := ctx.GetStub().GetState(key)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read from world state: %v", err)
+		}
+		if value == nil {
+			return nil, fmt.Errorf("No record is stored under %q", key)
+		}
+		issues, err := diagnoseRecord(ctx, key, value)
+		if err != nil {
+			return nil, err
+		}
+
+		result := &RepairResult{Key: key, Action: RepairNone, Issues: issues}
+		for _, issue := range issues {
+			switch {
+			case quarantinedIssues[issue.Kind]:
+				result.Action = RepairQuarantined
+			case issue.Fixable && result.Action == RepairNone:
+				result.Action = RepairFixed
+			}
+		}
+		switch result.Action {
+		case RepairQuarantined:
+			err = quarantineRecord(ctx, key, value, issues)
+		case RepairFixed:
+			err = fixRecord(ctx, key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// QueryQuarantinedRecords returns the records moved to quarantine.
+func (s *AdminContract) QueryQuarantinedRecords(ctx contractapi.TransactionContextInterface) ([]*QuarantinedRecord, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(quarantineObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	records := []*QuarantinedRecord{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var record QuarantinedRecord
+		err = json.Unmarshal(queryResponse.Value, &record)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, &record)
+	}
+	return records, nil
+}
+
+func checkProductPage(ctx contractapi.TransactionContextInterface, report *IntegrityReport, pageSize int32, bookmark string) (string, error) {
+	resultsIterator, metadata, err := ctx.GetStub().GetStateByRangeWithPagination("", "", pageSize, bookmark)
+	if err != nil {
+		return "", err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return "", err
+		}
+		issues, err := diagnoseProduct(ctx, queryResponse.Key, queryResponse.Value)
+		if err != nil {
+			return "", err
+		}
+		report.Scanned++
+		report.Issues = append(report.Issues, issues...)
+	}
+	return pageEnd(metadata, pageSize), nil
+}
+
+func checkIndexPage(ctx contractapi.TransactionContextInterface, report *IntegrityReport, objectType string, pageSize int32, bookmark string) (string, error) {
+	resultsIterator, metadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(objectType, []string{}, pageSize, bookmark)
+	if err != nil {
+		return "", err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return "", err
+		}
+		issues, err := diagnoseRecord(ctx, queryResponse.Key, queryResponse.Value)
+		if err != nil {
+			return "", err
+		}
+		report.Scanned++
+		report.Issues = append(report.Issues, issues...)
+	}
+	return pageEnd(metadata, pageSize), nil
+}
+
+// pageEnd returns the bookmark of the next page, or "" after the last one.
+func pageEnd(metadata *peer.QueryResponseMetadata, pageSize int32) string {
+	if metadata == nil || metadata.GetFetchedRecordsCount() < pageSize {
+		return ""
+	}
+	return metadata.GetBookmark()
+}
+
+// diagnoseRecord checks a product record or index entry.
+func diagnoseRecord(ctx contractapi.TransactionContextInterface, key string, value []byte) ([]*IntegrityIssue, error) {
+	if !strings.HasPrefix(key, "\x00") {
+		return diagnoseProduct(ctx, key, value)
+	}
+	objectType, attributes, err := ctx.GetStub().SplitCompositeKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	orphaned := func(detail string, args ...interface{}) ([]*IntegrityIssue, error) {
+		return []*IntegrityIssue{{Key: key, Kind: IssueOrphanedIndex, Detail: fmt.Sprintf(detail, args...), Fixable: true}}, nil
+	}
+	switch {
+	case objectType == sgtinObjectType && len(attributes) == 2:
+		product, exists, err := lookupProduct(ctx, string(value))
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return orphaned("The SGTIN (01)%s(21)%s points at the missing product %s", attributes[0], attributes[1], value)
+		}
+		if product != nil && (product.SGTIN == nil || product.SGTIN.GTIN != attributes[0] || product.SGTIN.Serial != attributes[1]) {
+			return orphaned("The SGTIN (01)%s(21)%s is not the SGTIN of product %s", attributes[0], attributes[1], value)
+		}
+	case objectType == modelGTINObjectType && len(attributes) == 1:
+		model, err := readModel(ctx, string(value))
+		if err != nil {
+			return nil, err
+		}
+		if model == nil {
+			return orphaned("The GTIN %s points at the missing model %s", attributes[0], value)
+		}
+		if model.GTIN != attributes[0] {
+			return orphaned("The GTIN %s is not the GTIN of model %s", attributes[0], value)
+		}
+	case objectType == pairingObjectType && len(attributes) == 2:
+		component, exists, err := lookupProduct(ctx, attributes[1])
+		if err != nil {
+			return nil, err
+		}
+		if !exists || component != nil && component.ParentID != attributes[0] {
+			return orphaned("The product %s is not installed in %s", attributes[1], attributes[0])
+		}
+	default:
+		return nil, fmt.Errorf("The key %q is not a product or index key", key)
+	}
+	return []*IntegrityIssue{}, nil
+}
+
+// diagnoseProduct checks a product record and its references.
+func diagnoseProduct(ctx contractapi.TransactionContextInterface, key string, value []byte) ([]*IntegrityIssue, error) {
+	issue := func(kind string, fixable bool, detail string, args ...interface{}) *IntegrityIssue {
+		return &IntegrityIssue{Key: key, Kind: kind, Detail: fmt.Sprintf(detail, args...), Fixable: fixable}
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return []*IntegrityIssue{issue(IssueMalformed, false, "The record is not a JSON object: %v", err)}, nil
+	}
+	// records written by a newer chaincode version are left to it
+	var header struct {
+		SchemaVersion int `json:"schemaVersion"`
+	}
+	if json.Unmarshal(value, &header) == nil && header.SchemaVersion > productSchemaVersion {
+		return []*IntegrityIssue{}, nil
+	}
+	product, err := unmarshalProduct(value)
+	if err != nil {
+		return []*IntegrityIssue{issue(IssueMalformed, false, "The record is not a product: %v", err)}, nil
+	}
+	issues := []*IntegrityIssue{}
+	for _, field := range requiredProductFields {
+		if _, ok := fields[field]; !ok {
+			issues = append(issues, issue(IssueMissingField, false, "The product has no %s", field))
+		}
+	}
+	if product.ID != key {
+		issues = append(issues, issue(IssueKeyMismatch, false, "The record holds the product %s", product.ID))
+	}
+	if len(issues) > 0 {
+		return issues, nil
+	}
+
+	if product.ModelID != "" {
+		model, err := readModel(ctx, product.ModelID)
+		if err != nil {
+			return nil, err
+		}
+		if model == nil {
+			issues = append(issues, issue(IssueUnknownModel, false, "The model %s is not registered", product.ModelID))
+		}
+	}
+
+	references := append([]string{}, product.Components...)
+	if product.ParentID != "" {
+		references = append(references, product.ParentID)
+	}
+	for _, id := range references {
+		exists, err := productExists(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			issues = append(issues, issue(IssueDanglingReference, true, "The product %s does not exist", id))
+		}
+	}
+	if product.ShipmentID != "" {
+		shipment, err := readShipment(ctx, product.ShipmentID)
+		if err != nil {
+			return nil, err
+		}
+		if shipment == nil {
+			issues = append(issues, issue(IssueDanglingReference, true, "The shipment %s does not exist", product.ShipmentID))
+		}
+	}
+	return issues, nil
+}
+
+// fixRecord repairs the fixable issues of a readable record.
+func fixRecord(ctx contractapi.TransactionContextInterface, key string) error {
+	if strings.HasPrefix(key, "\x00") {
+		// only orphaned index entries are fixable among composite keys
+		return ctx.GetStub().DelState(key)
+	}
+
+	product, err := readProduct(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	components := []string{}
+	for _, id := range product.Components {
+		exists, err := productExists(ctx, id)
+		if err != nil {
+			return err
+		}
+		if exists {
+			components = append(components, id)
+		}
+	}
+	product.Components = components
+	if product.ParentID != "" {
+		exists, err := productExists(ctx, product.ParentID)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			product.ParentID = ""
+		}
+	}
+	if product.ShipmentID != "" {
+		shipment, err := readShipment(ctx, product.ShipmentID)
+		if err != nil {
+			return err
+		}
+		if shipment == nil {
+			product.ShipmentID = ""
+		}
+	}
+	return putProduct(ctx, product)
+}
+
+// quarantineRecord moves the record out of its key so that it no longer breaks readers. A product
+// record is removed like a deleted product: the removal is audited and the keys that belong to
+// it go with it.
+func quarantineRecord(ctx contractapi.TransactionContextInterface, key string, value []byte, issues []*IntegrityIssue) error {
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	record := &QuarantinedRecord{
+		Key:           key,
+		Value:         string(value),
+		Issues:        issues,
+		QuarantinedAt: now,
+		TxID:          ctx.GetStub().GetTxID(),
+	}
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	quarantineKey, err := ctx.GetStub().CreateCompositeKey(quarantineObjectType, []string{key, record.TxID})
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(quarantineKey, recordJSON); err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	if !strings.HasPrefix(key, "\x00") {
+		if err := removeProductKeys(ctx, key, value); err != nil {
+			return err
+		}
+		if err := recordDeletion(ctx, key); err != nil {
+			return err
+		}
+		if err := recordProductStats(ctx, key, nil); err != nil {
+			return err
+		}
+		markProductChanged(ctx, key)
+	}
+	return ctx.GetStub().DelState(key)
+}
+
+// removeProductKeys deletes the SGTIN entry, pairings and endorsement override of the product
+// stored under the key, reading whatever fields of the record are still intact.
+func removeProductKeys(ctx contractapi.TransactionContextInterface, key string, value []byte) error {
+	var product Product
+	// a record of the wrong shape still fills the fields that fit
+	_ = json.Unmarshal(value, &product)
+
+	if product.SGTIN != nil {
+		sgtinKey, err := ctx.GetStub().CreateCompositeKey(sgtinObjectType, []string{product.SGTIN.GTIN, product.SGTIN.Serial})
+		if err != nil {
+			return err
+		}
+		productID, err := ctx.GetStub().GetState(sgtinKey)
+		if err != nil {
+			return fmt.Errorf("Failed to read from world state: %v", err)
+		}
+		if string(productID) == key {
+			if err := ctx.GetStub().DelState(sgtinKey); err != nil {
+				return err
+			}
+		}
+	}
+	if product.ParentID != "" {
+		if err := deletePairing(ctx, product.ParentID, key); err != nil {
+			return err
+		}
+	}
+	for _, componentID := range product.Components {
+		if err := deletePairing(ctx, key, componentID); err != nil {
+			return err
+		}
+	}
+	return deleteEndorsementOverride(ctx, key)
+}
+
+// lookupProduct returns the product with given id and whether it exists. The product is nil when
+// its record is unreadable, which the check reports on the record itself.
+func lookupProduct(ctx contractapi.TransactionContextInterface, id string) (*Product, bool, error) {
+	productJSON, err := ctx.GetStub().GetState(id)
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	if productJSON == nil {
+		return nil, false, nil
+	}
+	product, err := unmarshalProduct(productJSON)
+	if err != nil {
+		return nil, true, nil
+	}
+	return product, true, nil
+}
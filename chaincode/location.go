@@ -0,0 +1,33 @@
+package chaincode
+
+import "fmt"
+
+// Location identifies the site where a product was last seen, such as a GS1 SGLN, and the
+// organization operating it
+type Location struct {
+	SiteID string          `json:"siteID"`
+	Org    string          `json:"org"`
+	Geo    *GeoCoordinates `json:"geo,omitempty" metadata:"geo,optional"`
+}
+
+// GeoCoordinates is a WGS 84 position in decimal degrees
+type GeoCoordinates struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// validateLocation checks the location and defaults its organization to the given one.
+func validateLocation(location *Location, org string) error {
+	if location.SiteID == "" {
+		return fmt.Errorf("The location has no site ID")
+	}
+	if location.Org == "" {
+		location.Org = org
+	}
+	if geo := location.Geo; geo != nil {
+		if geo.Latitude < -90 || geo.Latitude > 90 || geo.Longitude < -180 || geo.Longitude > 180 {
+			return fmt.Errorf("The coordinates %v,%v are out of range", geo.Latitude, geo.Longitude)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	modelObjectType     = "model"
+	modelGTINObjectType = "modelGTIN"
+)
+
+// Model describes a product model, optionally identified by a GS1 GTIN-14
+type Model struct {
+	ID   string `json:"ID"`
+	Name string `json:"name"`
+	Make string `json:"make"`
+	GTIN string `json:"gtin,omitempty" metadata:"gtin,optional"`
+}
+
+// AddModel registers a product model of the caller's make. The GTIN is optional; when given it
+// must carry a valid check digit and must not be used by another model.
+func (s *ModelContract) AddModel(ctx contractapi.TransactionContextInterface, id string, name string, make string, gtin string) error {
+	if _, err := assertMakeManufacturer(ctx, make); err != nil {
+		return err
+	}
+	existing, err := readModel(ctx, id)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("The model %s already exists", id)
+	}
+
+	model := &Model{ID: id, Name: name, Make: make}
+	if gtin != "" {
+		if err := assignModelGTIN(ctx, model, gtin); err != nil {
+			return err
+		}
+	}
+	return putModel(ctx, model)
+}
+
+// SetModelGTIN assigns or replaces the GTIN of a model of the caller's make.
+func (s *ModelContract) SetModelGTIN(ctx contractapi.TransactionContextInterface, id string, gtin string) error {
+	model, err := queryModel(ctx, id)
+	if err != nil {
+		return err
+	}
+	if _, err := assertMakeManufacturer(ctx, model.Make); err != nil {
+		return err
+	}
+	if err := assignModelGTIN(ctx, model, gtin); err != nil {
+		return err
+	}
+	return putModel(ctx, model)
+}
+
+// QueryModel returns the model with given id.
+func (s *QueryContract) QueryModel(ctx contractapi.TransactionContextInterface, id string) (*Model, error) {
+	return queryModel(ctx, id)
+}
+
+// queryModel returns the model with given id, failing when it does not exist.
+func queryModel(ctx contractapi.TransactionContextInterface, id string) (*Model, error) {
+	model, err := readModel(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if model == nil {
+		return nil, fmt.Errorf("The model %s does not exist", id)
+	}
+	return model, nil
+}
+
+// QueryAllModels returns all registered models.
+func (s *QueryContract) QueryAllModels(ctx contractapi.TransactionContextInterface) ([]*Model, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(modelObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var models []*Model
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var model Model
+		err = json.Unmarshal(queryResponse.Value, &model)
+		if err != nil {
+			return nil, err
+		}
+		models = append(models, &model)
+	}
+
+	return models, nil
+}
+
+// assignModelGTIN validates the GTIN, moves the model's entry in the GTIN uniqueness index and
+// sets it on the model. The model itself is written by the caller.
+func assignModelGTIN(ctx contractapi.TransactionContextInterface, model *Model, gtin string) error {
+	gtin, err := normalizeGTIN(gtin)
+	if err != nil {
+		return err
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(modelGTINObjectType, []string{gtin})
+	if err != nil {
+		return err
+	}
+	owner, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	if owner != nil && string(owner) != model.ID {
+		return fmt.Errorf("The GTIN %s is already used by model %s", gtin, owner)
+	}
+
+	if model.GTIN != "" && model.GTIN != gtin {
+		oldKey, err := ctx.GetStub().CreateCompositeKey(modelGTINObjectType, []string{model.GTIN})
+		if err != nil {
+			return err
+		}
+		if err := ctx.GetStub().DelState(oldKey); err != nil {
+			return err
+		}
+	}
+	if err := ctx.GetStub().PutState(key, []byte(model.ID)); err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+
+	model.GTIN = gtin
+	return nil
+}
+
+// readModel returns the model with given id, or nil if none exists.
+func readModel(ctx contractapi.TransactionContextInterface, id string) (*Model, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(modelObjectType, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	modelJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	if modelJSON == nil {
+		return nil, nil
+	}
+
+	var model Model
+	err = json.Unmarshal(modelJSON, &model)
+	if err != nil {
+		return nil, err
+	}
+	return &model, nil
+}
+
+func putModel(ctx contractapi.TransactionContextInterface, model *Model) error {
+	modelJSON, err := json.Marshal(model)
+	if err != nil {
+		return err
+	}
+	key, err := ctx.GetStub().CreateCompositeKey(modelObjectType, []string{model.ID})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(key, modelJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package chaincode
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	orgRoleObjectType = "orgRole"
+	makeObjectType    = "make"
+)
+
+// Organization roles that gate role-specific transactions
+const (
+	RoleManufacturer = "manufacturer"
+	RoleRetailer     = "retailer"
+	RoleCarrier      = "carrier"
+	RoleRefurbisher  = "refurbisher"
+	RoleRecycler     = "recycler"
+)
+
+var knownRoles = map[string]bool{
+	RoleManufacturer: true,
+	RoleRetailer:     true,
+	RoleCarrier:      true,
+	RoleRefurbisher:  true,
+	RoleRecycler:     true,
+}
+
+// RegisterOrgRole grants the role to the organization with given MSP ID.
+func (s *AdminContract) RegisterOrgRole(ctx contractapi.TransactionContextInterface, mspID string, role string) error {
+	if !knownRoles[role] {
+		return fmt.Errorf("The role %s is not known", role)
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(orgRoleObjectType, []string{mspID, role})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(key, []byte(role))
+	if err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	return nil
+}
+
+// RevokeOrgRole withdraws the role from the organization with given MSP ID.
+func (s *AdminContract) RevokeOrgRole(ctx contractapi.TransactionContextInterface, mspID string, role string) error {
+	key, err := ctx.GetStub().CreateCompositeKey(orgRoleObjectType, []string{mspID, role})
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().DelState(key)
+}
+
+// RegisterMake records the manufacturer with given MSP ID as the maker of products of the make,
+// replacing any previous registration.
+func (s *AdminContract) RegisterMake(ctx contractapi.TransactionContextInterface, make string, mspID string) error {
+	if make == "" {
+		return fmt.Errorf("The make must not be empty")
+	}
+	ok, err := hasOrgRole(ctx, mspID, RoleManufacturer)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("The organization %s is not a registered %s", mspID, RoleManufacturer)
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(makeObjectType, []string{make})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(key, []byte(mspID))
+	if err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	return nil
+}
+
+// QueryMakeManufacturer returns the MSP ID of the manufacturer registered for the make.
+func (s *QueryContract) QueryMakeManufacturer(ctx contractapi.TransactionContextInterface, make string) (string, error) {
+	mspID, err := makeManufacturer(ctx, make)
+	if err != nil {
+		return "", err
+	}
+	if mspID == "" {
+		return "", fmt.Errorf("No manufacturer is registered for the make %s", make)
+	}
+	return mspID, nil
+}
+
+// QueryOrgRoles returns the roles granted to the organization with given MSP ID.
+func (s *QueryContract) QueryOrgRoles(ctx contractapi.TransactionContextInterface, mspID string) ([]string, error) {
+	return orgRoles(ctx, mspID)
+}
+
+// orgRoles returns the sorted roles granted to the organization.
+func orgRoles(ctx contractapi.TransactionContextInterface, mspID string) ([]string, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(orgRoleObjectType, []string{mspID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	roles := []string{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, string(queryResponse.Value))
+	}
+	sort.Strings(roles)
+
+	return roles, nil
+}
+
+// hasOrgRole reports whether the organization with given MSP ID holds the role.
+func hasOrgRole(ctx contractapi.TransactionContextInterface, mspID string, role string) (bool, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(orgRoleObjectType, []string{mspID, role})
+	if err != nil {
+		return false, err
+	}
+	roleBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return false, fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	return roleBytes != nil, nil
+}
+
+// makeManufacturer returns the MSP ID of the manufacturer registered for the make, or "" if none is.
+func makeManufacturer(ctx contractapi.TransactionContextInterface, make string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(makeObjectType, []string{make})
+	if err != nil {
+		return "", err
+	}
+	mspID, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	return string(mspID), nil
+}
+
+// assertMakeManufacturer fails unless the submitting organization is a manufacturer registered
+// for the make, and returns its MSP ID.
+func assertMakeManufacturer(ctx contractapi.TransactionContextInterface, make string) (string, error) {
+	mspID, err := assertOrgRole(ctx, RoleManufacturer)
+	if err != nil {
+		return "", err
+	}
+	manufacturer, err := makeManufacturer(ctx, make)
+	if err != nil {
+		return "", err
+	}
+	if manufacturer != mspID {
+		return "", fmt.Errorf("The organization %s is not the registered manufacturer of the make %s", mspID, make)
+	}
+	return mspID, nil
+}
+
+// assertOrgRole fails unless the submitting organization holds the role, and returns its MSP ID.
+func assertOrgRole(ctx contractapi.TransactionContextInterface, role string) (string, error) {
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return "", err
+	}
+	ok, err := hasOrgRole(ctx, mspID, role)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("The organization %s is not a registered %s", mspID, role)
+	}
+	return mspID, nil
+}
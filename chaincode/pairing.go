@@ -0,0 +1,226 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const pairingObjectType = "pairing"
+
+// pairableStatuses lists the product statuses a component may be in when it is installed
+var pairableStatuses = map[int]bool{
+	StatusRegistered:  true,
+	StatusRefurbished: true,
+}
+
+// Pairing records which service organization installed a component in a host product
+type Pairing struct {
+	HostID      string `json:"hostID"`
+	ComponentID string `json:"componentID"`
+	ServiceOrg  string `json:"serviceOrg"`
+	ServicedBy  string `json:"servicedBy"`
+	TxID        string `json:"txID"`
+	PairedAt    string `json:"pairedAt"`
+}
+
+// PairingIssue describes a component that failed verification
+type PairingIssue struct {
+	ComponentID string `json:"componentID"`
+	Reason      string `json:"reason"`
+}
+
+// PairingReport lists every non-genuine or flagged component of a host product
+type PairingReport struct {
+	HostID  string          `json:"hostID"`
+	Genuine bool            `json:"genuine"`
+	Issues  []*PairingIssue `json:"issues,omitempty" metadata:"issues,optional"`
+}
+
+// componentIssue returns why the component may not be paired with the host, or "" when it may.
+// A component must belong either to the servicing organization or to the owner of the host.
+func componentIssue(host *Product, component *Product, serviceOrg string) string {
+	if component.Stolen {
+		return "reported stolen"
+	}
+	if !pairableStatuses[component.Status] {
+		return fmt.Sprintf("status %d does not allow pairing", component.Status)
+	}
+	if component.Owner != serviceOrg && component.Owner != host.Owner {
+		return fmt.Sprintf("owned by %s", component.Owner)
+	}
+	return ""
+}
+
+// hostIssue returns why the host may not take components, or "" when it may.
+func hostIssue(host *Product) string {
+	if host.Stolen {
+		return "reported stolen"
+	}
+	if host.ShipmentID != "" {
+		return fmt.Sprintf("packed in %s", host.ShipmentID)
+	}
+	return ""
+}
+
+// assertServiceOrg fails unless the submitting organization owns the product or is a registered
+// refurbisher, which services products of other owners, and returns its MSP ID.
+func assertServiceOrg(ctx contractapi.TransactionContextInterface, product *Product) (string, error) {
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return "", err
+	}
+	if product.Owner == mspID {
+		return mspID, nil
+	}
+	ok, err := hasOrgRole(ctx, mspID, RoleRefurbisher)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("The product %s is not owned by %s, which is not a registered %s", product.ID, mspID, RoleRefurbisher)
+	}
+	return mspID, nil
+}
+
+// recordPairing stores the pairing of a component with its host under the servicing identity.
+func recordPairing(ctx contractapi.TransactionContextInterface, hostID string, componentID string) error {
+	serviceOrg, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	servicedBy, err := clientID(ctx)
+	if err != nil {
+		return err
+	}
+	pairedAt, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	pairing := Pairing{
+		HostID:      hostID,
+		ComponentID: componentID,
+		ServiceOrg:  serviceOrg,
+		ServicedBy:  servicedBy,
+		TxID:        ctx.GetStub().GetTxID(),
+		PairedAt:    pairedAt,
+	}
+	pairingJSON, err := json.Marshal(pairing)
+	if err != nil {
+		return err
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(pairingObjectType, []string{hostID, componentID})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(key, pairingJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	return nil
+}
+
+// readPairing returns the pairing record of a component with its host, or nil if none exists.
+func readPairing(ctx contractapi.TransactionContextInterface, hostID string, componentID string) (*Pairing, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(pairingObjectType, []string{hostID, componentID})
+	if err != nil {
+		return nil, err
+	}
+	pairingJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	if pairingJSON == nil {
+		return nil, nil
+	}
+
+	var pairing Pairing
+	err = json.Unmarshal(pairingJSON, &pairing)
+	if err != nil {
+		return nil, err
+	}
+	return &pairing, nil
+}
+
+// deletePairing removes the pairing record of a component with its host.
+func deletePairing(ctx contractapi.TransactionContextInterface, hostID string, componentID string) error {
+	key, err := ctx.GetStub().CreateCompositeKey(pairingObjectType, []string{hostID, componentID})
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().DelState(key)
+}
+
+// QueryPairing returns the pairing record of the component installed in the host product.
+func (s *QueryContract) QueryPairing(ctx contractapi.TransactionContextInterface, hostID string, componentID string) (*Pairing, error) {
+	pairing, err := readPairing(ctx, hostID, componentID)
+	if err != nil {
+		return nil, err
+	}
+	if pairing == nil {
+		return nil, fmt.Errorf("The product %s has no pairing record for %s", hostID, componentID)
+	}
+	return pairing, nil
+}
+
+// VerifyPairing checks every component installed in the host product, including nested ones,
+// and reports the parts that are not genuine or have been flagged.
+func (s *QueryContract) VerifyPairing(ctx contractapi.TransactionContextInterface, hostID string) (*PairingReport, error) {
+	host, err := readProduct(ctx, hostID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &PairingReport{HostID: hostID}
+	if err := verifyComponents(ctx, host, host.Owner, report); err != nil {
+		return nil, err
+	}
+	report.Genuine = len(report.Issues) == 0
+
+	return report, nil
+}
+
+// verifyComponents appends an issue to the report for every flagged component below host.
+func verifyComponents(ctx contractapi.TransactionContextInterface, host *Product, owner string, report *PairingReport) error {
+	for _, componentID := range host.Components {
+		exists, err := productExists(ctx, componentID)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			report.Issues = append(report.Issues, &PairingIssue{ComponentID: componentID, Reason: "not registered on the ledger"})
+			continue
+		}
+
+		component, err := readProduct(ctx, componentID)
+		if err != nil {
+			return err
+		}
+
+		pairing, err := readPairing(ctx, host.ID, componentID)
+		if err != nil {
+			return err
+		}
+
+		var reason string
+		switch {
+		case component.ParentID != host.ID:
+			reason = fmt.Sprintf("recorded as installed in %q", component.ParentID)
+		case pairing == nil:
+			reason = "no pairing record"
+		default:
+			reason = componentIssue(host, component, owner)
+		}
+		if reason != "" {
+			report.Issues = append(report.Issues, &PairingIssue{ComponentID: componentID, Reason: reason})
+		}
+
+		if err := verifyComponents(ctx, component, owner, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,545 @@
+package chaincode
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	passportObjectType         = "passport"
+	passportOverrideObjectType = "passportOverride"
+)
+
+// passportAccessAttribute is the certificate attribute listing the restricted passport sections,
+// recycler and authority, that an identity outside the manufacturer may read.
+const passportAccessAttribute = "passport"
+
+// passportTransientKey is the transient field carrying the recycler and authority sections of a
+// passport, or a patch of them, so they never appear in the transaction proposal recorded on the
+// ledger.
+const passportTransientKey = "passportRestricted"
+
+// Sections a passport override may patch, depending on where it is passed
+var (
+	publicPassportSections     = map[string]bool{"public": true}
+	restrictedPassportSections = map[string]bool{PassportRecycler: true, PassportAuthority: true}
+)
+
+// Restricted passport audiences
+const (
+	PassportRecycler  = "recycler"
+	PassportAuthority = "authority"
+)
+
+// Material is the share of a material in the product's mass, in percent
+type Material struct {
+	Name          string  `json:"name"`
+	Share         float64 `json:"share"`
+	RecycledShare float64 `json:"recycledShare,omitempty" metadata:"recycledShare,optional"`
+}
+
+// PassportPublic is the part of a Digital Product Passport anyone may read
+type PassportPublic struct {
+	CarbonFootprint       float64    `json:"carbonFootprint"`
+	MaterialComposition   []Material `json:"materialComposition"`
+	RepairabilityScore    float64    `json:"repairabilityScore"`
+	RecyclingInstructions string     `json:"recyclingInstructions"`
+}
+
+// PassportRecyclerInfo is the part of a passport restricted to recyclers
+type PassportRecyclerInfo struct {
+	DisassemblyInstructions string   `json:"disassemblyInstructions"`
+	HazardousSubstances     []string `json:"hazardousSubstances,omitempty" metadata:"hazardousSubstances,optional"`
+}
+
+// PassportAuthorityInfo is the part of a passport restricted to market surveillance authorities
+type PassportAuthorityInfo struct {
+	ConformityDeclaration string   `json:"conformityDeclaration"`
+	CarbonFootprintMethod string   `json:"carbonFootprintMethod,omitempty" metadata:"carbonFootprintMethod,optional"`
+	SupplierDeclarations  []string `json:"supplierDeclarations,omitempty" metadata:"supplierDeclarations,optional"`
+}
+
+// PassportData is the sustainability data of a Digital Product Passport. Carbon footprint is in
+// kg CO2e over the life cycle and repairability is scored from 0 to 10.
+type PassportData struct {
+	Public    PassportPublic         `json:"public"`
+	Recycler  *PassportRecyclerInfo  `json:"recycler,omitempty" metadata:"recycler,optional"`
+	Authority *PassportAuthorityInfo `json:"authority,omitempty" metadata:"authority,optional"`
+}
+
+// ModelPassport is the passport shared by every unit of a model. The world state holds the
+// public section only.
+type ModelPassport struct {
+	ModelID      string       `json:"modelID"`
+	Manufacturer string       `json:"manufacturer"`
+	UpdatedAt    string       `json:"updatedAt"`
+	Data         PassportData `json:"data"`
+}
+
+// PassportOverride is a JSON merge patch (RFC 7386) over the public section of a model passport
+// for a single unit. A patch of the restricted sections is kept in the manufacturer's collection.
+type PassportOverride struct {
+	ProductID string `json:"productID"`
+	Patch     string `json:"patch"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+// ProductPassport is the passport of a unit, with the restricted sections the caller may not read left out
+type ProductPassport struct {
+	ProductID    string                 `json:"productID"`
+	ModelID      string                 `json:"modelID"`
+	Manufacturer string                 `json:"manufacturer"`
+	Overridden   bool                   `json:"overridden"`
+	UpdatedAt    string                 `json:"updatedAt"`
+	Public       PassportPublic         `json:"public"`
+	Recycler     *PassportRecyclerInfo  `json:"recycler,omitempty" metadata:"recycler,optional"`
+	Authority    *PassportAuthorityInfo `json:"authority,omitempty" metadata:"authority,optional"`
+}
+
+// SetModelPassport creates or replaces the passport of a model. Only the registered manufacturer
+// of the model's make maintains it. The recycler and authority sections are passed as a JSON
+// object in the transient map and kept in the manufacturer's implicit private data collection.
+func (s *ModelContract) SetModelPassport(ctx contractapi.TransactionContextInterface, modelID string, public PassportPublic) error {
+	model, err := queryModel(ctx, modelID)
+	if err != nil {
+		return err
+	}
+	manufacturer, err := assertMakeManufacturer(ctx, model.Make)
+	if err != nil {
+		return err
+	}
+	restrictedJSON, err := passportTransient(ctx)
+	if err != nil {
+		return err
+	}
+	data := PassportData{Public: public}
+	if restrictedJSON != nil {
+		if err := unmarshalRestrictedPassport(restrictedJSON, &data); err != nil {
+			return err
+		}
+	}
+	if err := validatePassport(&data); err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := putPassportPrivateData(ctx, manufacturer, passportObjectType, modelID, restrictedJSON); err != nil {
+		return err
+	}
+	return putPassportState(ctx, passportObjectType, modelID, &ModelPassport{
+		ModelID:      modelID,
+		Manufacturer: manufacturer,
+		UpdatedAt:    now,
+		Data:         PassportData{Public: public},
+	})
+}
+
+// SetProductPassportOverride stores a JSON merge patch that overrides the model passport for a
+// single product, such as {"public":{"carbonFootprint":61.5}}. The argument patches the public
+// section only; a patch of the recycler and authority sections is passed in the transient map and
+// kept in the manufacturer's implicit private data collection. Each call replaces the whole
+// override, and an empty patch with no transient patch removes it.
+func (s *ProductContract) SetProductPassportOverride(ctx contractapi.TransactionContextInterface, productID string, patch string) error {
+	product, err := readProduct(ctx, productID)
+	if err != nil {
+		return err
+	}
+	model, err := queryModel(ctx, product.ModelID)
+	if err != nil {
+		return err
+	}
+	mspID, err := assertMakeManufacturer(ctx, model.Make)
+	if err != nil {
+		return err
+	}
+	passport, err := readModelPassport(ctx, product.ModelID)
+	if err != nil {
+		return err
+	}
+	if passport == nil {
+		return fmt.Errorf("The model %s has no passport", product.ModelID)
+	}
+	if passport.Manufacturer != mspID {
+		return fmt.Errorf("The passport of model %s is maintained by %s", product.ModelID, passport.Manufacturer)
+	}
+	restrictedPatch, err := passportTransient(ctx)
+	if err != nil {
+		return err
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(passportOverrideObjectType, []string{productID})
+	if err != nil {
+		return err
+	}
+	if patch == "" && restrictedPatch == nil {
+		if err := putPassportPrivateData(ctx, mspID, passportOverrideObjectType, productID, nil); err != nil {
+			return err
+		}
+		return ctx.GetStub().DelState(key)
+	}
+
+	data := &passport.Data
+	if err := readRestrictedPassport(ctx, mspID, passportObjectType, product.ModelID, data); err != nil {
+		return err
+	}
+	if patch != "" {
+		if data, err = applyPassportOverride(data, patch, publicPassportSections); err != nil {
+			return err
+		}
+	}
+	if restrictedPatch != nil {
+		if _, err := applyPassportOverride(data, string(restrictedPatch), restrictedPassportSections); err != nil {
+			return err
+		}
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := putPassportPrivateData(ctx, mspID, passportOverrideObjectType, productID, restrictedPatch); err != nil {
+		return err
+	}
+	return putPassportState(ctx, passportOverrideObjectType, productID, &PassportOverride{
+		ProductID: productID,
+		Patch:     patch,
+		UpdatedAt: now,
+	})
+}
+
+// QueryModelPassport returns the public part of a model passport, and the restricted parts the
+// caller may read. Restricted parts are only available on the peers of the maintaining manufacturer.
+func (s *QueryContract) QueryModelPassport(ctx contractapi.TransactionContextInterface, modelID string) (*ModelPassport, error) {
+	passport, err := readModelPassport(ctx, modelID)
+	if err != nil {
+		return nil, err
+	}
+	if passport == nil {
+		return nil, fmt.Errorf("The model %s has no passport", modelID)
+	}
+	if err := readRestrictedPassport(ctx, passport.Manufacturer, passportObjectType, modelID, &passport.Data); err != nil {
+		return nil, err
+	}
+	return passport, nil
+}
+
+// QueryProductPassport returns the passport of a product: its model passport merged with the
+// product's override. Recycler and authority sections are only returned to the maintaining
+// manufacturer, admins and identities whose passport certificate attribute grants them, from the
+// peers of the maintaining manufacturer.
+func (s *QueryContract) QueryProductPassport(ctx contractapi.TransactionContextInterface, productID string) (*ProductPassport, error) {
+	product, err := readProduct(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	passport, err := readModelPassport(ctx, product.ModelID)
+	if err != nil {
+		return nil, err
+	}
+	if passport == nil {
+		return nil, fmt.Errorf("The model %s has no passport", product.ModelID)
+	}
+
+	result := &ProductPassport{
+		ProductID:    productID,
+		ModelID:      product.ModelID,
+		Manufacturer: passport.Manufacturer,
+		UpdatedAt:    passport.UpdatedAt,
+	}
+	data := &passport.Data
+	if err := readRestrictedPassport(ctx, passport.Manufacturer, passportObjectType, product.ModelID, data); err != nil {
+		return nil, err
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(passportOverrideObjectType, []string{productID})
+	if err != nil {
+		return nil, err
+	}
+	overrideJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	if overrideJSON != nil {
+		var override PassportOverride
+		if err := json.Unmarshal(overrideJSON, &override); err != nil {
+			return nil, err
+		}
+		if override.Patch != "" {
+			data, err = applyPassportOverride(data, override.Patch, publicPassportSections)
+			if err != nil {
+				return nil, err
+			}
+		}
+		recycler, authority, err := passportAudiences(ctx, passport.Manufacturer)
+		if err != nil {
+			return nil, err
+		}
+		if recycler || authority {
+			restrictedPatch, err := readPassportPrivateData(ctx, passport.Manufacturer, passportOverrideObjectType, productID)
+			if err != nil {
+				return nil, err
+			}
+			if restrictedPatch != nil {
+				data, err = applyPassportOverride(data, string(restrictedPatch), restrictedPassportSections)
+				if err != nil {
+					return nil, err
+				}
+				restrictPassport(data, recycler, authority)
+			}
+		}
+		result.Overridden = true
+		if override.UpdatedAt > result.UpdatedAt {
+			result.UpdatedAt = override.UpdatedAt
+		}
+	}
+
+	result.Public = data.Public
+	result.Recycler = data.Recycler
+	result.Authority = data.Authority
+	return result, nil
+}
+
+// passportAudiences reports which restricted sections of a passport maintained by the
+// manufacturer the caller may read.
+func passportAudiences(ctx contractapi.TransactionContextInterface, manufacturer string) (bool, bool, error) {
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return false, false, err
+	}
+	if mspID == manufacturer || assertAdmin(ctx) == nil {
+		return true, true, nil
+	}
+
+	granted := map[string]bool{}
+	value, ok, err := ctx.GetClientIdentity().GetAttributeValue(passportAccessAttribute)
+	if err != nil {
+		return false, false, fmt.Errorf("Failed to read the %s attribute: %v", passportAccessAttribute, err)
+	}
+	if ok {
+		for _, audience := range strings.Split(value, ",") {
+			granted[strings.TrimSpace(audience)] = true
+		}
+	}
+	return granted[PassportRecycler], granted[PassportAuthority], nil
+}
+
+// readRestrictedPassport adds the restricted sections the caller may read to the passport data
+// from the manufacturer's collection, leaving the collection alone when it may read none.
+func readRestrictedPassport(ctx contractapi.TransactionContextInterface, manufacturer string, objectType string, id string, data *PassportData) error {
+	recycler, authority, err := passportAudiences(ctx, manufacturer)
+	if err != nil || !recycler && !authority {
+		return err
+	}
+	restrictedJSON, err := readPassportPrivateData(ctx, manufacturer, objectType, id)
+	if err != nil || restrictedJSON == nil {
+		return err
+	}
+	if err := unmarshalRestrictedPassport(restrictedJSON, data); err != nil {
+		return err
+	}
+	restrictPassport(data, recycler, authority)
+	return nil
+}
+
+// restrictPassport removes the restricted sections the caller may not read.
+func restrictPassport(data *PassportData, recycler bool, authority bool) {
+	if !recycler {
+		data.Recycler = nil
+	}
+	if !authority {
+		data.Authority = nil
+	}
+}
+
+// unmarshalRestrictedPassport sets the recycler and authority sections of the passport data from
+// a JSON object holding only those sections.
+func unmarshalRestrictedPassport(restrictedJSON []byte, data *PassportData) error {
+	var restricted PassportData
+	decoder := json.NewDecoder(bytes.NewReader(restrictedJSON))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&restricted); err != nil {
+		return fmt.Errorf("The restricted passport sections are not valid: %v", err)
+	}
+	if !reflect.DeepEqual(restricted.Public, PassportPublic{}) {
+		return fmt.Errorf("The public passport section is passed as an argument, not in the transient map")
+	}
+	data.Recycler = restricted.Recycler
+	data.Authority = restricted.Authority
+	return nil
+}
+
+// applyPassportOverride merges the JSON merge patch, which may only touch the given sections, into
+// a copy of the passport data and validates the result.
+func applyPassportOverride(data *PassportData, patch string, sections map[string]bool) (*PassportData, error) {
+	var patchValue interface{}
+	if err := json.Unmarshal([]byte(patch), &patchValue); err != nil {
+		return nil, fmt.Errorf("The passport override is not valid JSON: %v", err)
+	}
+	patchObject, ok := patchValue.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("The passport override must be a JSON object")
+	}
+	for section := range patchObject {
+		if !sections[section] {
+			return nil, fmt.Errorf("The passport override cannot patch the %s section here; the public section is patched by the argument, the restricted sections in the transient map", section)
+		}
+	}
+
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var target interface{}
+	if err := json.Unmarshal(dataJSON, &target); err != nil {
+		return nil, err
+	}
+	mergedJSON, err := json.Marshal(mergePatch(target, patchValue))
+	if err != nil {
+		return nil, err
+	}
+
+	var merged PassportData
+	if err := json.Unmarshal(mergedJSON, &merged); err != nil {
+		return nil, fmt.Errorf("The passport override does not fit the passport: %v", err)
+	}
+	if err := validatePassport(&merged); err != nil {
+		return nil, err
+	}
+	return &merged, nil
+}
+
+// mergePatch applies an RFC 7386 JSON merge patch to a decoded JSON value.
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+		} else {
+			targetObject[name] = mergePatch(targetObject[name], value)
+		}
+	}
+	return targetObject
+}
+
+func validatePassport(data *PassportData) error {
+	public := data.Public
+	switch {
+	case public.CarbonFootprint < 0:
+		return fmt.Errorf("The carbon footprint must not be negative")
+	case public.RepairabilityScore < 0 || public.RepairabilityScore > 10:
+		return fmt.Errorf("The repairability score %v is not between 0 and 10", public.RepairabilityScore)
+	case public.RecyclingInstructions == "":
+		return fmt.Errorf("The recycling instructions are required")
+	case len(public.MaterialComposition) == 0:
+		return fmt.Errorf("The material composition is required")
+	}
+
+	total := 0.0
+	for _, material := range public.MaterialComposition {
+		if material.Name == "" || material.Share <= 0 || material.RecycledShare < 0 || material.RecycledShare > 100 {
+			return fmt.Errorf("The material %q needs a positive share and a recycled share between 0 and 100", material.Name)
+		}
+		total += material.Share
+	}
+	if total > 100 {
+		return fmt.Errorf("The material shares add up to %v%%, more than 100%%", total)
+	}
+	return nil
+}
+
+func readModelPassport(ctx contractapi.TransactionContextInterface, modelID string) (*ModelPassport, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(passportObjectType, []string{modelID})
+	if err != nil {
+		return nil, err
+	}
+	passportJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	if passportJSON == nil {
+		return nil, nil
+	}
+
+	var passport ModelPassport
+	err = json.Unmarshal(passportJSON, &passport)
+	if err != nil {
+		return nil, err
+	}
+	return &passport, nil
+}
+
+func putPassportState(ctx contractapi.TransactionContextInterface, objectType string, id string, value interface{}) error {
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	key, err := ctx.GetStub().CreateCompositeKey(objectType, []string{id})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(key, valueJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	return nil
+}
+
+// passportTransient returns the restricted passport sections, or a patch of them, passed in the
+// transient map, or nil when none are passed.
+func passportTransient(ctx contractapi.TransactionContextInterface) ([]byte, error) {
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get transient data: %v", err)
+	}
+	value := transient[passportTransientKey]
+	if len(value) == 0 {
+		return nil, nil
+	}
+	return value, nil
+}
+
+func readPassportPrivateData(ctx contractapi.TransactionContextInterface, manufacturer string, objectType string, id string) ([]byte, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(objectType, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	value, err := ctx.GetStub().GetPrivateData(implicitCollection(manufacturer), key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read private data: %v", err)
+	}
+	return value, nil
+}
+
+// putPassportPrivateData stores the value in the manufacturer's collection, or deletes the
+// stored value when it is nil.
+func putPassportPrivateData(ctx contractapi.TransactionContextInterface, manufacturer string, objectType string, id string, value []byte) error {
+	key, err := ctx.GetStub().CreateCompositeKey(objectType, []string{id})
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		if err := ctx.GetStub().DelPrivateData(implicitCollection(manufacturer), key); err != nil {
+			return fmt.Errorf("Failed to delete private data: %v", err)
+		}
+		return nil
+	}
+	if err := ctx.GetStub().PutPrivateData(implicitCollection(manufacturer), key, value); err != nil {
+		return fmt.Errorf("Failed to put private data: %v", err)
+	}
+	return nil
+}
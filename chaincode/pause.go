@@ -0,0 +1,243 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	pauseObjectType        = "pause"
+	pauseHistoryObjectType = "pauseHistory"
+)
+
+// PauseAll is the scope of a pause that blocks every write transaction
+const PauseAll = "*"
+
+// Pause blocks write transactions in its scope, every write transaction or a single one, until
+// an admin resumes them. A resumed pause is kept in the pause history with the resume details.
+type Pause struct {
+	Scope        string `json:"scope"`
+	Reason       string `json:"reason"`
+	PausedBy     string `json:"pausedBy"`
+	PausedAt     string `json:"pausedAt"`
+	TxID         string `json:"txID"`
+	ResumeReason string `json:"resumeReason,omitempty" metadata:"resumeReason,optional"`
+	ResumedBy    string `json:"resumedBy,omitempty" metadata:"resumedBy,optional"`
+	ResumedAt    string `json:"resumedAt,omitempty" metadata:"resumedAt,optional"`
+	ResumeTxID   string `json:"resumeTxID,omitempty" metadata:"resumeTxID,optional"`
+}
+
+// ContractStatus reports whether write transactions are available
+type ContractStatus struct {
+	Paused        bool     `json:"paused"`
+	Pauses        []*Pause `json:"pauses"`
+	ConfigVersion int      `json:"configVersion"`
+}
+
+// Pause blocks the product and model transaction with given name, or all of them for the scope
+// "*". Queries and admin transactions stay available.
+func (s *AdminContract) Pause(ctx contractapi.TransactionContextInterface, scope string, reason string) error {
+	if reason == "" {
+		return fmt.Errorf("A reason is required to pause")
+	}
+	if scope != PauseAll && !pausableTransactions()[scope] {
+		return fmt.Errorf("The scope %s is neither %s nor a product or model transaction", scope, PauseAll)
+	}
+	existing, err := readPause(ctx, scope)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("The scope %s is already paused: %s", scope, existing.Reason)
+	}
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	pause := &Pause{
+		Scope:    scope,
+		Reason:   reason,
+		PausedBy: mspID,
+		PausedAt: now,
+		TxID:     ctx.GetStub().GetTxID(),
+	}
+	pauseJSON, err := json.Marshal(pause)
+	if err != nil {
+		return err
+	}
+	key, err := ctx.GetStub().CreateCompositeKey(pauseObjectType, []string{scope})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(key, pauseJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	return nil
+}
+
+// Resume lifts the pause of the given scope and records who lifted it and why in the pause
+// history. Lifting the "*" pause leaves pauses of single transactions in place.
+func (s *AdminContract) Resume(ctx contractapi.TransactionContextInterface, scope string, reason string) error {
+	if reason == "" {
+		return fmt.Errorf("A reason is required to resume")
+	}
+	pause, err := readPause(ctx, scope)
+	if err != nil {
+		return err
+	}
+	if pause == nil {
+		return fmt.Errorf("The scope %s is not paused", scope)
+	}
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	pause.ResumeReason = reason
+	pause.ResumedBy = mspID
+	pause.ResumedAt = now
+	pause.ResumeTxID = ctx.GetStub().GetTxID()
+	pauseJSON, err := json.Marshal(pause)
+	if err != nil {
+		return err
+	}
+	// history keys sort by the time the pause started
+	historyKey, err := ctx.GetStub().CreateCompositeKey(pauseHistoryObjectType, []string{pause.PausedAt, pause.TxID})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(historyKey, pauseJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(pauseObjectType, []string{scope})
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().DelState(key)
+}
+
+// GetPauseHistory returns the pauses that were resumed, oldest first.
+func (s *AdminContract) GetPauseHistory(ctx contractapi.TransactionContextInterface) ([]*Pause, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(pauseHistoryObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	pauses := []*Pause{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var pause Pause
+		err = json.Unmarshal(queryResponse.Value, &pause)
+		if err != nil {
+			return nil, err
+		}
+		pauses = append(pauses, &pause)
+	}
+	return pauses, nil
+}
+
+// GetContractStatus returns the pauses in force and the configuration version.
+func (s *QueryContract) GetContractStatus(ctx contractapi.TransactionContextInterface) (*ContractStatus, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(pauseObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	status := &ContractStatus{Pauses: []*Pause{}}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var pause Pause
+		err = json.Unmarshal(queryResponse.Value, &pause)
+		if err != nil {
+			return nil, err
+		}
+		if pause.Scope == PauseAll {
+			status.Paused = true
+		}
+		status.Pauses = append(status.Pauses, &pause)
+	}
+
+	config, err := loadConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status.ConfigVersion = config.Version
+	return status, nil
+}
+
+// assertNotPaused fails with a PAUSED error when the transaction, or every write transaction, is paused.
+func assertNotPaused(ctx contractapi.TransactionContextInterface) error {
+	function, _ := ctx.GetStub().GetFunctionAndParameters()
+	if i := strings.LastIndex(function, ":"); i >= 0 {
+		function = function[i+1:]
+	}
+
+	for _, scope := range []string{PauseAll, function} {
+		pause, err := readPause(ctx, scope)
+		if err != nil {
+			return err
+		}
+		if pause != nil {
+			return fmt.Errorf("PAUSED: The transaction %s is paused since %s: %s", function, pause.PausedAt, pause.Reason)
+		}
+	}
+	return nil
+}
+
+// pausableTransactions returns the names of the product and model transactions.
+func pausableTransactions() map[string]bool {
+	names := map[string]bool{}
+	for _, contract := range []interface{}{new(ProductContract), new(ModelContract)} {
+		for _, name := range transactionNames(reflect.TypeOf(contract)) {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+func readPause(ctx contractapi.TransactionContextInterface, scope string) (*Pause, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(pauseObjectType, []string{scope})
+	if err != nil {
+		return nil, err
+	}
+	pauseJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	if pauseJSON == nil {
+		return nil, nil
+	}
+
+	var pause Pause
+	err = json.Unmarshal(pauseJSON, &pause)
+	if err != nil {
+		return nil, err
+	}
+	return &pause, nil
+}
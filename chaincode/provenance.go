@@ -0,0 +1,109 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-samples/asset-transfer-fabcar/chaincode-go/credential"
+)
+
+// productCredential is the W3C Verifiable Credential rendered by ExportProductCredential
+type productCredential struct {
+	Context           []string                  `json:"@context"`
+	ID                string                    `json:"id"`
+	Type              []string                  `json:"type"`
+	Issuer            string                    `json:"issuer"`
+	ValidFrom         string                    `json:"validFrom"`
+	CredentialSchema  credentialSchema          `json:"credentialSchema"`
+	CredentialSubject *productCredentialSubject `json:"credentialSubject"`
+}
+
+type credentialSchema struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+type productCredentialSubject struct {
+	ID      string          `json:"id"`
+	Product *Product        `json:"product"`
+	Model   *Model          `json:"model,omitempty"`
+	Custody []*CustodyEvent `json:"custody"`
+	Service productService  `json:"service"`
+}
+
+type productService struct {
+	FirmwareUpdates []*FirmwareUpdate `json:"firmwareUpdates"`
+	RMAs            []*RMA            `json:"rmas"`
+	Refurbishment   *Refurbishment    `json:"refurbishment,omitempty"`
+}
+
+// ExportProductCredential renders the product, its model and its custody and service history as
+// an unsigned W3C Verifiable Credential issued by the manufacturer of the product's make. The
+// manufacturer secures it with an eddsa-jcs-2022 Data Integrity proof using credential.Sign and
+// its own registered key, and it is checked offline with the credential package.
+func (s *QueryContract) ExportProductCredential(ctx contractapi.TransactionContextInterface, productID string) (string, error) {
+	product, err := readProduct(ctx, productID)
+	if err != nil {
+		return "", err
+	}
+	mspID, err := assertMakeManufacturer(ctx, product.Make)
+	if err != nil {
+		return "", err
+	}
+	model, err := readModel(ctx, product.ModelID)
+	if err != nil {
+		return "", err
+	}
+
+	chain, err := custodyChain(ctx, productID)
+	if err != nil {
+		return "", err
+	}
+	custody := []*CustodyEvent{}
+	for _, hop := range chain.Hops {
+		custody = append(custody, hop.Event)
+	}
+	firmwareUpdates, err := firmwareTimeline(ctx, productID)
+	if err != nil {
+		return "", err
+	}
+	rmas, err := queryRMAs(ctx, func(rma *RMA) bool { return rma.ProductID == productID })
+	if err != nil {
+		return "", err
+	}
+	service := productService{
+		FirmwareUpdates: []*FirmwareUpdate{},
+		RMAs:            []*RMA{},
+		Refurbishment:   product.Refurbishment,
+	}
+	service.FirmwareUpdates = append(service.FirmwareUpdates, firmwareUpdates...)
+	service.RMAs = append(service.RMAs, rmas...)
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	issuedAt := now.Format(time.RFC3339)
+
+	unsigned, err := json.Marshal(productCredential{
+		Context:          []string{credential.CredentialsContextURL, credential.ProductContextURL},
+		ID:               "urn:fabcar:credential:" + ctx.GetStub().GetTxID(),
+		Type:             []string{"VerifiableCredential", "ProductProvenanceCredential"},
+		Issuer:           credential.IssuerID(mspID),
+		ValidFrom:        issuedAt,
+		CredentialSchema: credentialSchema{ID: credential.ProductSchemaURL, Type: "JsonSchema"},
+		CredentialSubject: &productCredentialSubject{
+			ID:      credential.SubjectID(productID),
+			Product: product,
+			Model:   model,
+			Custody: custody,
+			Service: service,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return string(unsigned), nil
+}
@@ -0,0 +1,78 @@
+package chaincode
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ConditionRefurbished marks a product that re-entered the market after refurbishment.
+// Products without a condition are new.
+const ConditionRefurbished = "refurbished"
+
+var refurbishmentGrades = map[string]bool{"A": true, "B": true, "C": true}
+
+// Refurbishment is the certification of the latest refurbishment of a product
+type Refurbishment struct {
+	Grade           string `json:"grade"`
+	ChecklistResult string `json:"checklistResult"`
+	RefurbishedBy   string `json:"refurbishedBy"`
+	Refurbisher     string `json:"refurbisher"`
+	RefurbishedAt   string `json:"refurbishedAt"`
+	WarrantyMonths  int    `json:"warrantyMonths"`
+}
+
+// RefurbishProduct re-certifies a returned or restocked product with the given grade (A, B or C)
+// and starts a new warranty term. Only certified refurbisher organizations may call it.
+func (s *ProductContract) RefurbishProduct(ctx contractapi.TransactionContextInterface, id string, grade string, checklistResult string, warrantyMonths int) error {
+	refurbishedBy, err := assertOrgRole(ctx, RoleRefurbisher)
+	if err != nil {
+		return err
+	}
+	product, err := readProduct(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := assertOwner(ctx, product); err != nil {
+		return err
+	}
+
+	switch {
+	case product.Stolen:
+		return fmt.Errorf("The product %s is reported stolen", id)
+	case product.Status != StatusReturned && product.Status != StatusRegistered && product.Status != StatusRefurbished:
+		return fmt.Errorf("The product %s cannot be refurbished in status %d", id, product.Status)
+	case !refurbishmentGrades[grade]:
+		return fmt.Errorf("The grade %s is not one of A, B or C", grade)
+	case checklistResult == "":
+		return fmt.Errorf("The inspection checklist result is required")
+	case warrantyMonths < 0:
+		return fmt.Errorf("The warranty term must not be negative")
+	}
+
+	refurbisher, err := clientID(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	refurbishedAt := now.Format(time.RFC3339)
+
+	product.Condition = ConditionRefurbished
+	product.Refurbishment = &Refurbishment{
+		Grade:           grade,
+		ChecklistResult: checklistResult,
+		RefurbishedBy:   refurbishedBy,
+		Refurbisher:     refurbisher,
+		RefurbishedAt:   refurbishedAt,
+		WarrantyMonths:  warrantyMonths,
+	}
+	product.Status = StatusRefurbished
+	product.WarrantyUntil = now.AddDate(0, warrantyMonths, 0).Format(time.RFC3339)
+	product.UpdatedAt = refurbishedAt
+
+	return putProduct(ctx, product)
+}
@@ -0,0 +1,296 @@
+package chaincode
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Index change actions
+const (
+	IndexCreated  = "created"
+	IndexReplaced = "replaced"
+	IndexDeleted  = "deleted"
+	IndexConflict = "conflict"
+	IndexMissing  = "missing"
+)
+
+// reindexSections are rebuilt in order: missing entries are recreated while walking the product
+// records, stale SGTIN entries deleted while walking the SGTIN index. A bookmark names the section
+// it continues.
+var reindexSections = []string{"products", sgtinObjectType}
+
+// IndexChange is an index entry ReindexProducts changed, or would change in a dry run. Conflicts
+// are entries claimed by two products and missing pairings are installs nobody recorded, both
+// left for an admin to resolve.
+type IndexChange struct {
+	Key       string `json:"key"`
+	Index     string `json:"index"`
+	ProductID string `json:"productID"`
+	Action    string `json:"action"`
+	Detail    string `json:"detail,omitempty" metadata:"detail,optional"`
+}
+
+// ReindexSummary is one page of a partial index rebuild. The SGTIN index is rebuilt in full, but
+// the pairing index is only pruned: missing pairings are reported, not recreated.
+type ReindexSummary struct {
+	DryRun   bool           `json:"dryRun"`
+	Scanned  int            `json:"scanned"`
+	Changes  []*IndexChange `json:"changes"`
+	Skipped  []string       `json:"skipped"`
+	Bookmark string         `json:"bookmark,omitempty" metadata:"bookmark,optional"`
+	Done     bool           `json:"done"`
+}
+
+// ReindexProducts rebuilds the SGTIN index and prunes the pairing index from up to pageSize
+// product records or SGTIN entries, continuing from the bookmark of the previous page. Missing
+// SGTIN entries are recreated and SGTIN entries whose product is missing or holds another SGTIN
+// are deleted, as are pairings hosted by a product that no longer has the component installed.
+// Missing pairings are only reported, since the servicing identity they record cannot be
+// recovered. In a dry run the changes are only reported. Product records that cannot be read are
+// skipped, CheckIntegrity reports them. Pass the returned bookmark until the summary is done.
+func (s *AdminContract) ReindexProducts(ctx contractapi.TransactionContextInterface, pageSize int, bookmark string, dryRun bool) (*ReindexSummary, error) {
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("The page size must be positive")
+	}
+	section, startKey := reindexSections[0], ""
+	if bookmark != "" {
+		i := strings.Index(bookmark, "|")
+		if i < 0 {
+			return nil, fmt.Errorf("Malformed bookmark %q", bookmark)
+		}
+		section, startKey = bookmark[:i], bookmark[i+1:]
+	}
+	next := -1
+	for i, name := range reindexSections {
+		if name == section {
+			next = i + 1
+		}
+	}
+	if next < 0 {
+		return nil, fmt.Errorf("Malformed bookmark %q", bookmark)
+	}
+
+	summary := &ReindexSummary{DryRun: dryRun, Changes: []*IndexChange{}, Skipped: []string{}}
+	var err error
+	if section == reindexSections[0] {
+		startKey, err = reindexProductPage(ctx, summary, pageSize, startKey)
+	} else {
+		startKey, err = pruneSGTINPage(ctx, summary, pageSize, startKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !dryRun {
+		for _, change := range summary.Changes {
+			if err := applyIndexChange(ctx, change); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	switch {
+	case startKey != "":
+		summary.Bookmark = section + "|" + startKey
+	case next < len(reindexSections):
+		summary.Bookmark = reindexSections[next] + "|"
+	default:
+		summary.Done = true
+	}
+	return summary, nil
+}
+
+// reindexProductPage checks the index entries of a page of product records and returns the key
+// the next page starts at, or "" after the last one.
+func reindexProductPage(ctx contractapi.TransactionContextInterface, summary *ReindexSummary, pageSize int, startKey string) (string, error) {
+	// Fabric allows pagination in read-only transactions only, so pages are cut by hand
+	resultsIterator, err := ctx.GetStub().GetStateByRange(startKey, "")
+	if err != nil {
+		return "", err
+	}
+	defer resultsIterator.Close()
+
+	for page := 0; resultsIterator.HasNext(); page++ {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return "", err
+		}
+		if page == pageSize {
+			return queryResponse.Key, nil
+		}
+		summary.Scanned++
+
+		product, err := unmarshalProduct(queryResponse.Value)
+		if err != nil || product.ID != queryResponse.Key {
+			summary.Skipped = append(summary.Skipped, queryResponse.Key)
+			continue
+		}
+		if product.SGTIN != nil {
+			change, err := missingSGTINEntry(ctx, product)
+			if err != nil {
+				return "", err
+			}
+			if change != nil {
+				for _, earlier := range summary.Changes {
+					if earlier.Key == change.Key && earlier.Action != IndexConflict {
+						change.Action = IndexConflict
+						change.Detail = fmt.Sprintf("The SGTIN %s is also held by %s", product.SGTIN.elementString(), earlier.ProductID)
+					}
+				}
+				summary.Changes = append(summary.Changes, change)
+			}
+		}
+		if product.ParentID != "" {
+			pairing, err := readPairing(ctx, product.ParentID, product.ID)
+			if err != nil {
+				return "", err
+			}
+			if pairing == nil {
+				key, err := ctx.GetStub().CreateCompositeKey(pairingObjectType, []string{product.ParentID, product.ID})
+				if err != nil {
+					return "", err
+				}
+				summary.Changes = append(summary.Changes, &IndexChange{
+					Key:       key,
+					Index:     pairingObjectType,
+					ProductID: product.ID,
+					Action:    IndexMissing,
+					Detail:    fmt.Sprintf("The product %s has no pairing record for %s", product.ParentID, product.ID),
+				})
+			}
+		}
+		if err := staleHostedPairings(ctx, summary, product.ID); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// missingSGTINEntry returns the change that points the product's SGTIN at it, or nil when the
+// index already does.
+func missingSGTINEntry(ctx contractapi.TransactionContextInterface, product *Product) (*IndexChange, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(sgtinObjectType, []string{product.SGTIN.GTIN, product.SGTIN.Serial})
+	if err != nil {
+		return nil, err
+	}
+	holderID, err := productIDBySGTIN(ctx, product.SGTIN)
+	if err != nil {
+		return nil, err
+	}
+	change := &IndexChange{Key: key, Index: sgtinObjectType, ProductID: product.ID, Action: IndexCreated}
+	switch {
+	case holderID == product.ID:
+		return nil, nil
+	case holderID == "":
+		return change, nil
+	}
+
+	holder, exists, err := lookupProduct(ctx, holderID)
+	if err != nil {
+		return nil, err
+	}
+	if exists && holder != nil && holder.SGTIN != nil && holder.SGTIN.GTIN == product.SGTIN.GTIN && holder.SGTIN.Serial == product.SGTIN.Serial {
+		change.Action = IndexConflict
+		change.Detail = fmt.Sprintf("The SGTIN %s is also held by %s", product.SGTIN.elementString(), holderID)
+		return change, nil
+	}
+	change.Action = IndexReplaced
+	change.Detail = fmt.Sprintf("The SGTIN %s pointed at %s", product.SGTIN.elementString(), holderID)
+	return change, nil
+}
+
+// pruneSGTINPage deletes the entries of a page of the SGTIN index whose product is missing or
+// holds another SGTIN, and returns the key the next page starts at, or "" after the last one.
+func pruneSGTINPage(ctx contractapi.TransactionContextInterface, summary *ReindexSummary, pageSize int, startKey string) (string, error) {
+	// Fabric allows pagination in read-only transactions only and composite keys cannot be range
+	// queried, so the scan skips the entries of earlier pages
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(sgtinObjectType, []string{})
+	if err != nil {
+		return "", err
+	}
+	defer resultsIterator.Close()
+
+	page := 0
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return "", err
+		}
+		if queryResponse.Key < startKey {
+			continue
+		}
+		if page == pageSize {
+			return queryResponse.Key, nil
+		}
+		page++
+		summary.Scanned++
+
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return "", err
+		}
+		if len(attributes) != 2 {
+			continue
+		}
+		productID := string(queryResponse.Value)
+		product, exists, err := lookupProduct(ctx, productID)
+		if err != nil {
+			return "", err
+		}
+		// unreadable products keep their entries until CheckIntegrity deals with them
+		if exists && (product == nil || product.SGTIN != nil && product.SGTIN.GTIN == attributes[0] && product.SGTIN.Serial == attributes[1]) {
+			continue
+		}
+		summary.Changes = append(summary.Changes, &IndexChange{Key: queryResponse.Key, Index: sgtinObjectType, ProductID: productID, Action: IndexDeleted})
+	}
+	return "", nil
+}
+
+// staleHostedPairings adds a deletion for every pairing of the host whose component is no longer
+// installed in it.
+func staleHostedPairings(ctx contractapi.TransactionContextInterface, summary *ReindexSummary, hostID string) error {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(pairingObjectType, []string{hostID})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return err
+		}
+		if len(attributes) != 2 {
+			continue
+		}
+		component, exists, err := lookupProduct(ctx, attributes[1])
+		if err != nil {
+			return err
+		}
+		// missing and unreadable components are left for CheckIntegrity
+		if exists && component != nil && component.ParentID != hostID {
+			summary.Changes = append(summary.Changes, &IndexChange{Key: queryResponse.Key, Index: pairingObjectType, ProductID: attributes[1], Action: IndexDeleted})
+		}
+	}
+	return nil
+}
+
+// applyIndexChange writes a change found by ReindexProducts.
+func applyIndexChange(ctx contractapi.TransactionContextInterface, change *IndexChange) error {
+	switch change.Action {
+	case IndexDeleted:
+		return ctx.GetStub().DelState(change.Key)
+	case IndexConflict, IndexMissing:
+		return nil
+	}
+	if err := ctx.GetStub().PutState(change.Key, []byte(change.ProductID)); err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	return nil
+}
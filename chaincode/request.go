@@ -0,0 +1,313 @@
+package chaincode
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	requestObjectType      = "request"
+	requestIndexObjectType = "requestIndex"
+)
+
+// requestIndexBuckets is the number of buckets an organization's request index is spread over,
+// so that concurrent requests rarely update the same bucket.
+const requestIndexBuckets = 256
+
+// requestIDTransientKey is the transient field carrying the client's request ID. It is read from
+// the transient map so that it stays out of the transaction arguments.
+const requestIDTransientKey = "requestID"
+
+// RequestRecord is the outcome of a write transaction submitted with a client request ID
+type RequestRecord struct {
+	RequestID  string `json:"requestID"`
+	MSPID      string `json:"mspID"`
+	Function   string `json:"function"`
+	ArgsHash   string `json:"argsHash"`
+	TxID       string `json:"txID"`
+	Payload    string `json:"payload,omitempty" metadata:"payload,optional"`
+	RecordedAt string `json:"recordedAt"`
+}
+
+// Idempotent wraps the chaincode so that a write transaction submitted with a request ID in the
+// transient map executes once: a retry with the same request ID returns the recorded outcome of
+// the first execution instead of executing again.
+func Idempotent(chaincode shim.Chaincode) shim.Chaincode {
+	return &idempotentChaincode{chaincode}
+}
+
+type idempotentChaincode struct {
+	shim.Chaincode
+}
+
+// Invoke answers a retried request from its record, and records the outcome of a new one.
+func (cc *idempotentChaincode) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
+	function, _ := stub.GetFunctionAndParameters()
+	if isReadOnlyFunction(function) {
+		return cc.Chaincode.Invoke(stub)
+	}
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to get transient data: %v", err))
+	}
+	requestID := string(transient[requestIDTransientKey])
+	if requestID == "" {
+		return cc.Chaincode.Invoke(stub)
+	}
+
+	ctx, err := newStubContext(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	argsHash := hashArgs(stub.GetArgs())
+
+	record, err := readRequestRecord(ctx, mspID, requestID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if record != nil {
+		expired, err := requestExpired(ctx, record, now)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !expired {
+			if record.Function != function || record.ArgsHash != argsHash {
+				return shim.Error(fmt.Sprintf("The request ID %s was already used for a different %s call in transaction %s", requestID, record.Function, record.TxID))
+			}
+			return shim.Success([]byte(record.Payload))
+		}
+	}
+
+	// only successful executions commit, so a failed request is executed again on retry
+	response := cc.Chaincode.Invoke(stub)
+	if response.Status >= shim.ERRORTHRESHOLD {
+		return response
+	}
+
+	record = &RequestRecord{
+		RequestID:  requestID,
+		MSPID:      mspID,
+		Function:   function,
+		ArgsHash:   argsHash,
+		TxID:       stub.GetTxID(),
+		Payload:    string(response.Payload),
+		RecordedAt: now.Format(time.RFC3339),
+	}
+	if err := indexRequest(ctx, record, now); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := putRequestRecord(ctx, record); err != nil {
+		return shim.Error(err.Error())
+	}
+	return response
+}
+
+// QueryRequest returns the recorded outcome of the caller organization's request with given ID.
+func (s *QueryContract) QueryRequest(ctx contractapi.TransactionContextInterface, requestID string) (*RequestRecord, error) {
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	record, err := readRequestRecord(ctx, mspID, requestID)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, fmt.Errorf("The request %s does not exist", requestID)
+	}
+	return record, nil
+}
+
+// PurgeExpiredRequests deletes up to limit request records older than the retention window and
+// returns how many were deleted. New requests already delete the expired records of their index
+// bucket, so this only clears records of buckets that see no new requests.
+func (s *AdminContract) PurgeExpiredRequests(ctx contractapi.TransactionContextInterface, limit int) (int, error) {
+	if limit <= 0 {
+		return 0, fmt.Errorf("The limit must be positive")
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(requestObjectType, []string{})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	purged := 0
+	for purged < limit && resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		var record RequestRecord
+		err = json.Unmarshal(queryResponse.Value, &record)
+		if err != nil {
+			return 0, err
+		}
+		expired, err := requestExpired(ctx, &record, now)
+		if err != nil {
+			return 0, err
+		}
+		if !expired {
+			continue
+		}
+		if err := ctx.GetStub().DelState(queryResponse.Key); err != nil {
+			return 0, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// indexRequest lists the request in its bucket of the organization's request index and deletes
+// the records of the bucket that are past the retention window, so that request records do not
+// pile up. The bucket is read and written by key, so only concurrent requests of the same
+// organization falling in the same bucket conflict.
+func indexRequest(ctx contractapi.TransactionContextInterface, record *RequestRecord, now time.Time) error {
+	retention, err := requestRetention(ctx)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(record.RequestID))
+	bucket := fmt.Sprintf("%02x", int(sum[0])%requestIndexBuckets)
+	key, err := ctx.GetStub().CreateCompositeKey(requestIndexObjectType, []string{record.MSPID, bucket})
+	if err != nil {
+		return err
+	}
+	indexJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("Failed to read from world state: %v", err)
+	}
+
+	// request IDs mapped to when they were recorded
+	index := map[string]string{}
+	if indexJSON != nil {
+		if err := json.Unmarshal(indexJSON, &index); err != nil {
+			return err
+		}
+	}
+	for requestID, recordedAt := range index {
+		recorded, err := time.Parse(time.RFC3339, recordedAt)
+		if requestID == record.RequestID || err == nil && now.Sub(recorded) <= retention {
+			continue
+		}
+		recordKey, err := ctx.GetStub().CreateCompositeKey(requestObjectType, []string{record.MSPID, requestID})
+		if err != nil {
+			return err
+		}
+		if err := ctx.GetStub().DelState(recordKey); err != nil {
+			return err
+		}
+		delete(index, requestID)
+	}
+	index[record.RequestID] = record.RecordedAt
+
+	indexJSON, err = json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(key, indexJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	return nil
+}
+
+func requestExpired(ctx contractapi.TransactionContextInterface, record *RequestRecord, now time.Time) (bool, error) {
+	retention, err := requestRetention(ctx)
+	if err != nil {
+		return false, err
+	}
+	recordedAt, err := time.Parse(time.RFC3339, record.RecordedAt)
+	if err != nil {
+		return false, fmt.Errorf("The request %s has a malformed timestamp: %v", record.RequestID, err)
+	}
+	return now.Sub(recordedAt) > retention, nil
+}
+
+// isReadOnlyFunction reports whether the function belongs to the query contract or the system
+// contract, which never write and so need no request record.
+func isReadOnlyFunction(function string) bool {
+	return strings.HasPrefix(function, "QueryContract:") || strings.HasPrefix(function, "org.hyperledger.fabric:")
+}
+
+// hashArgs fingerprints the function name and arguments, so a request ID reused for a different
+// call is detected.
+func hashArgs(args [][]byte) string {
+	h := sha256.New()
+	for _, arg := range args {
+		fmt.Fprintf(h, "%d:", len(arg))
+		h.Write(arg)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// newStubContext builds a transaction context around the stub for code running outside a contract.
+func newStubContext(stub shim.ChaincodeStubInterface) (*TransactionContext, error) {
+	clientIdentity, err := cid.New(stub)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get client identity: %v", err)
+	}
+	ctx := new(TransactionContext)
+	ctx.SetStub(stub)
+	ctx.SetClientIdentity(clientIdentity)
+	return ctx, nil
+}
+
+func readRequestRecord(ctx contractapi.TransactionContextInterface, mspID string, requestID string) (*RequestRecord, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(requestObjectType, []string{mspID, requestID})
+	if err != nil {
+		return nil, err
+	}
+	recordJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	if recordJSON == nil {
+		return nil, nil
+	}
+
+	var record RequestRecord
+	err = json.Unmarshal(recordJSON, &record)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func putRequestRecord(ctx contractapi.TransactionContextInterface, record *RequestRecord) error {
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	key, err := ctx.GetStub().CreateCompositeKey(requestObjectType, []string{record.MSPID, record.RequestID})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(key, recordJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	return nil
+}
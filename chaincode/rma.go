@@ -0,0 +1,377 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const rmaObjectType = "rma"
+
+// RMA states
+const (
+	RMARequested = "REQUESTED"
+	RMAApproved  = "APPROVED"
+	RMARejected  = "REJECTED"
+	RMAReceived  = "RECEIVED"
+	RMAInspected = "INSPECTED"
+	RMAClosed    = "CLOSED"
+)
+
+// RMA dispositions
+const (
+	DispositionRestock   = "restock"
+	DispositionRefurbish = "refurbish"
+	DispositionScrap     = "scrap"
+)
+
+// RMA is a return merchandise authorization for a sold product
+type RMA struct {
+	ID               string `json:"ID"`
+	ProductID        string `json:"productID"`
+	State            string `json:"state"`
+	Reason           string `json:"reason"`
+	RequestedBy      string `json:"requestedBy"`
+	RequestedAt      string `json:"requestedAt"`
+	ReturnTo         string `json:"returnTo,omitempty" metadata:"returnTo,optional"`
+	ApprovedAt       string `json:"approvedAt,omitempty" metadata:"approvedAt,optional"`
+	RejectionReason  string `json:"rejectionReason,omitempty" metadata:"rejectionReason,optional"`
+	ReceivedAt       string `json:"receivedAt,omitempty" metadata:"receivedAt,optional"`
+	InspectionResult string `json:"inspectionResult,omitempty" metadata:"inspectionResult,optional"`
+	InspectedAt      string `json:"inspectedAt,omitempty" metadata:"inspectedAt,optional"`
+	Disposition      string `json:"disposition,omitempty" metadata:"disposition,optional"`
+	ClosedAt         string `json:"closedAt,omitempty" metadata:"closedAt,optional"`
+}
+
+// RequestRMA opens a return for the sold product with given id. Only the owner may request it.
+func (s *ProductContract) RequestRMA(ctx contractapi.TransactionContextInterface, rmaID string, productID string, reason string) error {
+	existing, err := readRMA(ctx, rmaID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("The RMA %s already exists", rmaID)
+	}
+
+	product, err := readProduct(ctx, productID)
+	if err != nil {
+		return err
+	}
+	if err := assertOwner(ctx, product); err != nil {
+		return err
+	}
+	if product.Stolen {
+		return fmt.Errorf("The product %s is reported stolen", productID)
+	}
+	if product.Status != StatusSold && product.Status != StatusActivated {
+		return fmt.Errorf("The product %s has not been sold", productID)
+	}
+	if product.RMAID != "" {
+		open, err := readRMA(ctx, product.RMAID)
+		if err != nil {
+			return err
+		}
+		if open != nil && rmaIsOpen(open) {
+			return fmt.Errorf("The product %s already has the open RMA %s", productID, product.RMAID)
+		}
+	}
+
+	requestedBy, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	rma := &RMA{
+		ID:          rmaID,
+		ProductID:   productID,
+		State:       RMARequested,
+		Reason:      reason,
+		RequestedBy: requestedBy,
+		RequestedAt: now,
+	}
+	if err := putRMA(ctx, rma); err != nil {
+		return err
+	}
+
+	product.RMAID = rmaID
+	return putProduct(ctx, product)
+}
+
+// ApproveRMA accepts a requested return. Only the manufacturer of the product's make may approve
+// it and becomes the organization the product is returned to.
+func (s *ProductContract) ApproveRMA(ctx contractapi.TransactionContextInterface, rmaID string) error {
+	rma, err := rmaInState(ctx, rmaID, RMARequested)
+	if err != nil {
+		return err
+	}
+	product, err := readProduct(ctx, rma.ProductID)
+	if err != nil {
+		return err
+	}
+	manufacturer, err := assertMakeManufacturer(ctx, product.Make)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	rma.State = RMAApproved
+	rma.ReturnTo = manufacturer
+	rma.ApprovedAt = now
+	return putRMA(ctx, rma)
+}
+
+// RejectRMA refuses a requested return and closes it. Only the manufacturer of the product's
+// make may reject it.
+func (s *ProductContract) RejectRMA(ctx contractapi.TransactionContextInterface, rmaID string, reason string) error {
+	rma, err := rmaInState(ctx, rmaID, RMARequested)
+	if err != nil {
+		return err
+	}
+	product, err := readProduct(ctx, rma.ProductID)
+	if err != nil {
+		return err
+	}
+	if _, err := assertMakeManufacturer(ctx, product.Make); err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	rma.State = RMARejected
+	rma.RejectionReason = reason
+	rma.ClosedAt = now
+	return putRMA(ctx, rma)
+}
+
+// ReceiveRMA records the arrival of the returned product, which passes to the receiving organization.
+func (s *ProductContract) ReceiveRMA(ctx contractapi.TransactionContextInterface, rmaID string) error {
+	rma, err := rmaInState(ctx, rmaID, RMAApproved)
+	if err != nil {
+		return err
+	}
+	if err := assertReturnTo(ctx, rma); err != nil {
+		return err
+	}
+	product, err := readProduct(ctx, rma.ProductID)
+	if err != nil {
+		return err
+	}
+	if product.Stolen {
+		return fmt.Errorf("The product %s is reported stolen", product.ID)
+	}
+	if isEndOfLife(product.Status) {
+		return fmt.Errorf("The product %s has reached end of life", product.ID)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	rma.State = RMAReceived
+	rma.ReceivedAt = now
+	if err := putRMA(ctx, rma); err != nil {
+		return err
+	}
+
+	product.Owner = rma.ReturnTo
+	if err := transferComponents(ctx, product, rma.ReturnTo); err != nil {
+		return err
+	}
+	product.Status = StatusReturned
+	product.UpdatedAt = now
+	if err := appendCustodyEvent(ctx, product.ID, CustodyReceive, "", nil); err != nil {
+		return err
+	}
+	return putProduct(ctx, product)
+}
+
+// InspectRMA records the inspection result of the returned product.
+func (s *ProductContract) InspectRMA(ctx contractapi.TransactionContextInterface, rmaID string, result string) error {
+	rma, err := rmaInState(ctx, rmaID, RMAReceived)
+	if err != nil {
+		return err
+	}
+	if err := assertReturnTo(ctx, rma); err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	rma.State = RMAInspected
+	rma.InspectionResult = result
+	rma.InspectedAt = now
+	return putRMA(ctx, rma)
+}
+
+// DispositionRMA closes the return: restock puts the product back into inventory as unsold,
+// refurbish leaves it returned for refurbishment and scrap retires it.
+func (s *ProductContract) DispositionRMA(ctx contractapi.TransactionContextInterface, rmaID string, disposition string) error {
+	rma, err := rmaInState(ctx, rmaID, RMAInspected)
+	if err != nil {
+		return err
+	}
+	if err := assertReturnTo(ctx, rma); err != nil {
+		return err
+	}
+	product, err := readProduct(ctx, rma.ProductID)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch disposition {
+	case DispositionRestock:
+		// the next buyer gets a warranty of their own
+		product.Status = StatusRegistered
+		product.SoldAt = ""
+		product.WarrantyUntil = ""
+		product.ActivatedAt = ""
+		product.ActivatedBy = ""
+	case DispositionRefurbish:
+		product.Status = StatusReturned
+	case DispositionScrap:
+		product.Status = StatusScrapped
+	default:
+		return fmt.Errorf("The disposition %s is not one of %s, %s or %s", disposition, DispositionRestock, DispositionRefurbish, DispositionScrap)
+	}
+
+	rma.State = RMAClosed
+	rma.Disposition = disposition
+	rma.ClosedAt = now
+	if err := putRMA(ctx, rma); err != nil {
+		return err
+	}
+
+	product.UpdatedAt = now
+	return putProduct(ctx, product)
+}
+
+// QueryRMA returns the RMA with given id.
+func (s *QueryContract) QueryRMA(ctx contractapi.TransactionContextInterface, rmaID string) (*RMA, error) {
+	rma, err := readRMA(ctx, rmaID)
+	if err != nil {
+		return nil, err
+	}
+	if rma == nil {
+		return nil, fmt.Errorf("The RMA %s does not exist", rmaID)
+	}
+	return rma, nil
+}
+
+// QueryOpenRMAs returns the RMAs not yet closed that the organization requested or receives.
+func (s *QueryContract) QueryOpenRMAs(ctx contractapi.TransactionContextInterface, mspID string) ([]*RMA, error) {
+	return queryRMAs(ctx, func(rma *RMA) bool {
+		return rmaIsOpen(rma) && (rma.RequestedBy == mspID || rma.ReturnTo == mspID)
+	})
+}
+
+// queryRMAs returns every RMA the filter accepts.
+func queryRMAs(ctx contractapi.TransactionContextInterface, filter func(*RMA) bool) ([]*RMA, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(rmaObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var rmas []*RMA
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var rma RMA
+		err = json.Unmarshal(queryResponse.Value, &rma)
+		if err != nil {
+			return nil, err
+		}
+		if filter(&rma) {
+			rmas = append(rmas, &rma)
+		}
+	}
+
+	return rmas, nil
+}
+
+func rmaIsOpen(rma *RMA) bool {
+	return rma.State != RMAClosed && rma.State != RMARejected
+}
+
+// rmaInState loads the RMA and fails unless it is in the expected state.
+func rmaInState(ctx contractapi.TransactionContextInterface, rmaID string, state string) (*RMA, error) {
+	rma, err := readRMA(ctx, rmaID)
+	if err != nil {
+		return nil, err
+	}
+	if rma == nil {
+		return nil, fmt.Errorf("The RMA %s does not exist", rmaID)
+	}
+	if rma.State != state {
+		return nil, fmt.Errorf("The RMA %s is %s, expected %s", rmaID, rma.State, state)
+	}
+	return rma, nil
+}
+
+// assertReturnTo fails unless the submitting organization is the one the product is returned to.
+func assertReturnTo(ctx contractapi.TransactionContextInterface, rma *RMA) error {
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	if rma.ReturnTo != mspID {
+		return fmt.Errorf("The RMA %s is handled by %s, not %s", rma.ID, rma.ReturnTo, mspID)
+	}
+	return nil
+}
+
+func readRMA(ctx contractapi.TransactionContextInterface, rmaID string) (*RMA, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(rmaObjectType, []string{rmaID})
+	if err != nil {
+		return nil, err
+	}
+	rmaJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	if rmaJSON == nil {
+		return nil, nil
+	}
+
+	var rma RMA
+	err = json.Unmarshal(rmaJSON, &rma)
+	if err != nil {
+		return nil, err
+	}
+	return &rma, nil
+}
+
+func putRMA(ctx contractapi.TransactionContextInterface, rma *RMA) error {
+	rmaJSON, err := json.Marshal(rma)
+	if err != nil {
+		return err
+	}
+	key, err := ctx.GetStub().CreateCompositeKey(rmaObjectType, []string{rma.ID})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(key, rmaJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	return nil
+}
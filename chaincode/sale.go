@@ -0,0 +1,155 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// customerRefTransientKey is the transient field carrying the pseudonymous customer reference,
+// so it never appears in the transaction proposal recorded on the ledger.
+const customerRefTransientKey = "customerRef"
+
+// SaleDetails is kept in the selling retailer's private collection
+type SaleDetails struct {
+	ProductID   string `json:"productID"`
+	CustomerRef string `json:"customerRef"`
+	SoldAt      string `json:"soldAt"`
+}
+
+// SellProduct records the retail sale of the product with given id and starts its warranty.
+// The customer reference is passed in the transient map and stored in the retailer's
+// implicit private data collection.
+func (s *ProductContract) SellProduct(ctx contractapi.TransactionContextInterface, id string, warrantyMonths int) error {
+	retailer, err := assertOrgRole(ctx, RoleRetailer)
+	if err != nil {
+		return err
+	}
+	product, err := readProduct(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := assertOwner(ctx, product); err != nil {
+		return err
+	}
+
+	switch {
+	case product.Stolen:
+		return fmt.Errorf("The product %s is reported stolen", id)
+	case product.Status == StatusRecalled:
+		return fmt.Errorf("The product %s is recalled", id)
+	case product.Status == StatusSold || product.Status == StatusActivated:
+		return fmt.Errorf("The product %s was already sold at %s", id, product.SoldAt)
+	case product.Status == StatusScrapped:
+		return fmt.Errorf("The product %s is scrapped", id)
+	case isEndOfLife(product.Status):
+		return fmt.Errorf("The product %s has reached end of life", id)
+	case product.Status == StatusInTransit:
+		return fmt.Errorf("The product %s is in transit", id)
+	case product.ShipmentID != "":
+		return fmt.Errorf("The product %s is packed in shipment %s", id, product.ShipmentID)
+	}
+	if warrantyMonths < 0 {
+		return fmt.Errorf("The warranty term must not be negative")
+	}
+
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return fmt.Errorf("Failed to get transient data: %v", err)
+	}
+	customerRef, ok := transient[customerRefTransientKey]
+	if !ok || len(customerRef) == 0 {
+		return fmt.Errorf("The %s field must be passed in the transient map", customerRefTransientKey)
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	soldAt := now.Format(time.RFC3339)
+
+	details := SaleDetails{
+		ProductID:   id,
+		CustomerRef: string(customerRef),
+		SoldAt:      soldAt,
+	}
+	detailsJSON, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutPrivateData(implicitCollection(retailer), id, detailsJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to put private data: %v", err)
+	}
+
+	product.Status = StatusSold
+	product.SoldAt = soldAt
+	product.WarrantyUntil = now.AddDate(0, warrantyMonths, 0).Format(time.RFC3339)
+	product.UpdatedAt = soldAt
+
+	return putProduct(ctx, product)
+}
+
+// QuerySaleDetails returns the private sale details of the product with given id from the
+// calling retailer's collection.
+func (s *QueryContract) QuerySaleDetails(ctx contractapi.TransactionContextInterface, id string) (*SaleDetails, error) {
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	detailsJSON, err := ctx.GetStub().GetPrivateData(implicitCollection(mspID), id)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read private data: %v", err)
+	}
+	if detailsJSON == nil {
+		return nil, fmt.Errorf("No sale of the product %s is recorded for %s", id, mspID)
+	}
+
+	var details SaleDetails
+	err = json.Unmarshal(detailsJSON, &details)
+	if err != nil {
+		return nil, err
+	}
+	return &details, nil
+}
+
+// ActivateDevice records the network activation of a sold product by a carrier.
+func (s *ProductContract) ActivateDevice(ctx contractapi.TransactionContextInterface, id string) error {
+	carrier, err := assertOrgRole(ctx, RoleCarrier)
+	if err != nil {
+		return err
+	}
+	product, err := readProduct(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case product.Stolen:
+		return fmt.Errorf("The product %s is reported stolen", id)
+	case product.Status == StatusActivated:
+		return fmt.Errorf("The product %s was already activated at %s", id, product.ActivatedAt)
+	case product.Status != StatusSold:
+		return fmt.Errorf("The product %s has not been sold", id)
+	}
+
+	activatedAt, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	product.Status = StatusActivated
+	product.ActivatedAt = activatedAt
+	product.ActivatedBy = carrier
+	product.UpdatedAt = activatedAt
+
+	return putProduct(ctx, product)
+}
+
+// implicitCollection returns the name of the implicit private data collection of an organization.
+func implicitCollection(mspID string) string {
+	return "_implicit_org_" + mspID
+}
@@ -0,0 +1,210 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const migrationObjectType = "migration"
+
+// productUpgrades upgrades a product record from the schema version at its index to the next
+// one. Upgrades work on the raw record, so that they can read fields the Product type no longer
+// has. Records written before schema versioning are version 0, the current layout. To change the
+// Product layout, append an upgrade.
+var productUpgrades = []func(record map[string]interface{}) error{}
+
+// productSchemaVersion is the schema version of the Product type, written by putProduct
+var productSchemaVersion = len(productUpgrades)
+
+// MigrationFailure is a product record that could not be upgraded
+type MigrationFailure struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+// MigrationProgress tracks the migration of product records to the current schema version
+// across transactions
+type MigrationProgress struct {
+	SchemaVersion int                 `json:"schemaVersion"`
+	NextKey       string              `json:"nextKey,omitempty" metadata:"nextKey,optional"`
+	Done          bool                `json:"done"`
+	Scanned       int                 `json:"scanned"`
+	Migrated      int                 `json:"migrated"`
+	Failures      []*MigrationFailure `json:"failures"`
+	StartedAt     string              `json:"startedAt"`
+	UpdatedAt     string              `json:"updatedAt"`
+}
+
+// MigrateProducts rewrites up to pageSize product records in the current schema version,
+// continuing where the previous call stopped, and returns the overall progress. Call it until
+// the progress is done. Records that fail to upgrade are reported and skipped. Rewriting a
+// product is subject to its endorsement policy, so every page needs the endorsement of the
+// owners of the products it rewrites.
+func (s *AdminContract) MigrateProducts(ctx contractapi.TransactionContextInterface, pageSize int) (*MigrationProgress, error) {
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("The page size must be positive")
+	}
+	progress, err := readMigrationProgress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if progress == nil || progress.SchemaVersion != productSchemaVersion {
+		progress = &MigrationProgress{SchemaVersion: productSchemaVersion, Failures: []*MigrationFailure{}, StartedAt: now}
+	}
+	if progress.Done {
+		return progress, nil
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByRange(progress.NextKey, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	progress.NextKey = ""
+	for page := 0; resultsIterator.HasNext(); page++ {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if page == pageSize {
+			progress.NextKey = queryResponse.Key
+			break
+		}
+		progress.Scanned++
+
+		version, err := productRecordVersion(queryResponse.Value)
+		if err == nil && version == productSchemaVersion {
+			continue
+		}
+		var product *Product
+		if err == nil {
+			product, err = unmarshalProduct(queryResponse.Value)
+		}
+		if err == nil && product.ID != queryResponse.Key {
+			err = fmt.Errorf("The record holds the product %s", product.ID)
+		}
+		if err != nil {
+			progress.Failures = append(progress.Failures, &MigrationFailure{Key: queryResponse.Key, Error: err.Error()})
+			continue
+		}
+		if err := putProduct(ctx, product); err != nil {
+			return nil, err
+		}
+		progress.Migrated++
+	}
+	progress.Done = progress.NextKey == ""
+	progress.UpdatedAt = now
+
+	if err := putMigrationProgress(ctx, progress); err != nil {
+		return nil, err
+	}
+	return progress, nil
+}
+
+// GetMigrationProgress returns the progress of the product migration, which has not started
+// when no start time is reported.
+func (s *AdminContract) GetMigrationProgress(ctx contractapi.TransactionContextInterface) (*MigrationProgress, error) {
+	progress, err := readMigrationProgress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if progress == nil {
+		return &MigrationProgress{Failures: []*MigrationFailure{}}, nil
+	}
+	return progress, nil
+}
+
+// unmarshalProduct reads a product record of any schema version up to the current one,
+// upgrading older records on the fly.
+func unmarshalProduct(productJSON []byte) (*Product, error) {
+	version, err := productRecordVersion(productJSON)
+	if err != nil {
+		return nil, err
+	}
+	if version < productSchemaVersion {
+		productJSON, err = upgradeProductRecord(productJSON, version)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var product Product
+	err = json.Unmarshal(productJSON, &product)
+	if err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+// productRecordVersion returns the schema version of a product record, failing for versions
+// written by a newer chaincode.
+func productRecordVersion(productJSON []byte) (int, error) {
+	var header struct {
+		SchemaVersion int `json:"schemaVersion"`
+	}
+	if err := json.Unmarshal(productJSON, &header); err != nil {
+		return 0, err
+	}
+	if header.SchemaVersion < 0 || header.SchemaVersion > productSchemaVersion {
+		return 0, fmt.Errorf("The product schema version %d is not supported, the latest is %d", header.SchemaVersion, productSchemaVersion)
+	}
+	return header.SchemaVersion, nil
+}
+
+func upgradeProductRecord(productJSON []byte, version int) ([]byte, error) {
+	var record map[string]interface{}
+	if err := json.Unmarshal(productJSON, &record); err != nil {
+		return nil, err
+	}
+	for ; version < productSchemaVersion; version++ {
+		if err := productUpgrades[version](record); err != nil {
+			return nil, fmt.Errorf("Failed to upgrade the product from schema version %d: %v", version, err)
+		}
+		record["schemaVersion"] = version + 1
+	}
+	return json.Marshal(record)
+}
+
+func readMigrationProgress(ctx contractapi.TransactionContextInterface) (*MigrationProgress, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(migrationObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	progressJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	if progressJSON == nil {
+		return nil, nil
+	}
+
+	var progress MigrationProgress
+	err = json.Unmarshal(progressJSON, &progress)
+	if err != nil {
+		return nil, err
+	}
+	return &progress, nil
+}
+
+func putMigrationProgress(ctx contractapi.TransactionContextInterface, progress *MigrationProgress) error {
+	progressJSON, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	key, err := ctx.GetStub().CreateCompositeKey(migrationObjectType, []string{})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(key, progressJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	return nil
+}
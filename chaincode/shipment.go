@@ -0,0 +1,339 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const shipmentObjectType = "shipment"
+
+// Shipment states
+const (
+	ShipmentPacked     = "PACKED"
+	ShipmentDispatched = "DISPATCHED"
+	ShipmentReceived   = "RECEIVED"
+)
+
+// Shipment kinds
+const (
+	KindShipment = "shipment"
+	KindPallet   = "pallet"
+	KindCarton   = "carton"
+)
+
+var shipmentKinds = map[string]bool{KindShipment: true, KindPallet: true, KindCarton: true}
+
+// Shipment aggregates products and nested pallets or cartons that move custody together
+type Shipment struct {
+	ID            string         `json:"ID"`
+	Kind          string         `json:"kind"`
+	State         string         `json:"state"`
+	From          string         `json:"from"`
+	To            string         `json:"to"`
+	ProductIDs    []string       `json:"productIDs,omitempty" metadata:"productIDs,optional"`
+	ChildIDs      []string       `json:"childIDs,omitempty" metadata:"childIDs,optional"`
+	ParentID      string         `json:"parentID,omitempty" metadata:"parentID,optional"`
+	PriorStatuses map[string]int `json:"priorStatuses,omitempty" metadata:"priorStatuses,optional"`
+	PackedAt      string         `json:"packedAt"`
+	DispatchedAt  string         `json:"dispatchedAt,omitempty" metadata:"dispatchedAt,optional"`
+	ReceivedAt    string         `json:"receivedAt,omitempty" metadata:"receivedAt,optional"`
+}
+
+// ShipmentTrace resolves the containers a product is packed in, innermost first
+type ShipmentTrace struct {
+	ProductID     string    `json:"productID"`
+	ContainerPath []string  `json:"containerPath"`
+	Shipment      *Shipment `json:"shipment"`
+}
+
+// PackShipment packs products owned by the caller, and previously packed pallets or cartons,
+// into a new container addressed to the destination organization.
+func (s *ProductContract) PackShipment(ctx contractapi.TransactionContextInterface, shipmentID string, kind string, productIDs []string, childIDs []string, destination string) error {
+	if !shipmentKinds[kind] {
+		return fmt.Errorf("The kind %s is not one of %s, %s or %s", kind, KindShipment, KindPallet, KindCarton)
+	}
+	if len(productIDs) == 0 && len(childIDs) == 0 {
+		return fmt.Errorf("The shipment %s is empty", shipmentID)
+	}
+	if destination == "" {
+		return fmt.Errorf("The shipment %s has no destination organization", shipmentID)
+	}
+	existing, err := readShipment(ctx, shipmentID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("The shipment %s already exists", shipmentID)
+	}
+
+	from, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	shipment := &Shipment{
+		ID:       shipmentID,
+		Kind:     kind,
+		State:    ShipmentPacked,
+		From:     from,
+		To:       destination,
+		PackedAt: now,
+	}
+	for _, productID := range productIDs {
+		if err := packProduct(ctx, shipment, productID); err != nil {
+			return err
+		}
+	}
+	for _, childID := range childIDs {
+		if err := packChild(ctx, shipment, childID); err != nil {
+			return err
+		}
+	}
+	return putShipment(ctx, shipment)
+}
+
+// packProduct adds a product owned by the caller to the container. The container is written by the caller.
+func packProduct(ctx contractapi.TransactionContextInterface, shipment *Shipment, productID string) error {
+	product, err := readProduct(ctx, productID)
+	if err != nil {
+		return err
+	}
+	if err := assertOwner(ctx, product); err != nil {
+		return err
+	}
+	switch {
+	case product.ShipmentID != "":
+		return fmt.Errorf("The product %s is already packed in %s", productID, product.ShipmentID)
+	case product.ParentID != "":
+		return fmt.Errorf("The product %s is installed in %s", productID, product.ParentID)
+	case product.Stolen:
+		return fmt.Errorf("The product %s is reported stolen", productID)
+	case isEndOfLife(product.Status):
+		return fmt.Errorf("The product %s has reached end of life", productID)
+	}
+
+	product.ShipmentID = shipment.ID
+	shipment.ProductIDs = append(shipment.ProductIDs, productID)
+	return putProduct(ctx, product)
+}
+
+// packChild nests a packed pallet or carton of the same sender in the container. The container is
+// written by the caller.
+func packChild(ctx contractapi.TransactionContextInterface, shipment *Shipment, childID string) error {
+	child, err := readShipment(ctx, childID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case child == nil:
+		return fmt.Errorf("The shipment %s does not exist", childID)
+	case child.From != shipment.From || child.State != ShipmentPacked:
+		return fmt.Errorf("The shipment %s is not packed by %s", childID, shipment.From)
+	case child.ParentID != "":
+		return fmt.Errorf("The shipment %s is already packed in %s", childID, child.ParentID)
+	case childID == shipment.ID:
+		return fmt.Errorf("The shipment %s cannot be packed in itself", childID)
+	}
+
+	child.ParentID = shipment.ID
+	child.To = shipment.To
+	shipment.ChildIDs = append(shipment.ChildIDs, childID)
+	return putShipment(ctx, child)
+}
+
+// DispatchShipment hands a top-level shipment to the carrier and puts every contained product in transit.
+func (s *ProductContract) DispatchShipment(ctx contractapi.TransactionContextInterface, shipmentID string) error {
+	shipment, err := queryShipment(ctx, shipmentID)
+	if err != nil {
+		return err
+	}
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	switch {
+	case shipment.From != mspID:
+		return fmt.Errorf("The shipment %s can only be dispatched by %s", shipmentID, shipment.From)
+	case shipment.ParentID != "":
+		return fmt.Errorf("The shipment %s is packed in %s and moves with it", shipmentID, shipment.ParentID)
+	case shipment.State != ShipmentPacked:
+		return fmt.Errorf("The shipment %s is %s, expected %s", shipmentID, shipment.State, ShipmentPacked)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	return walkShipment(ctx, shipment, func(container *Shipment, product *Product) error {
+		if product != nil {
+			if container.PriorStatuses == nil {
+				container.PriorStatuses = map[string]int{}
+			}
+			container.PriorStatuses[product.ID] = product.Status
+			product.Status = StatusInTransit
+			product.UpdatedAt = now
+			if err := appendCustodyEvent(ctx, product.ID, CustodyHandoff, container.To, nil); err != nil {
+				return err
+			}
+			return putProduct(ctx, product)
+		}
+		container.State = ShipmentDispatched
+		container.DispatchedAt = now
+		return putShipment(ctx, container)
+	})
+}
+
+// ReceiveShipment accepts a dispatched shipment at its destination. Custody of every contained
+// product passes to the receiving organization and the products leave the shipment.
+func (s *ProductContract) ReceiveShipment(ctx contractapi.TransactionContextInterface, shipmentID string) error {
+	shipment, err := queryShipment(ctx, shipmentID)
+	if err != nil {
+		return err
+	}
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	switch {
+	case shipment.To != mspID:
+		return fmt.Errorf("The shipment %s is addressed to %s, not %s", shipmentID, shipment.To, mspID)
+	case shipment.State != ShipmentDispatched:
+		return fmt.Errorf("The shipment %s is %s, expected %s", shipmentID, shipment.State, ShipmentDispatched)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	return walkShipment(ctx, shipment, func(container *Shipment, product *Product) error {
+		if product != nil {
+			product.Owner = container.To
+			if err := transferComponents(ctx, product, container.To); err != nil {
+				return err
+			}
+			if status, ok := container.PriorStatuses[product.ID]; ok {
+				product.Status = status
+			}
+			product.ShipmentID = ""
+			product.UpdatedAt = now
+			if err := appendCustodyEvent(ctx, product.ID, CustodyReceive, "", nil); err != nil {
+				return err
+			}
+			return putProduct(ctx, product)
+		}
+		container.State = ShipmentReceived
+		container.ReceivedAt = now
+		return putShipment(ctx, container)
+	})
+}
+
+// QueryShipment returns the shipment, pallet or carton with given id.
+func (s *QueryContract) QueryShipment(ctx contractapi.TransactionContextInterface, shipmentID string) (*Shipment, error) {
+	return queryShipment(ctx, shipmentID)
+}
+
+// queryShipment returns the shipment with given id, failing when it does not exist.
+func queryShipment(ctx contractapi.TransactionContextInterface, shipmentID string) (*Shipment, error) {
+	shipment, err := readShipment(ctx, shipmentID)
+	if err != nil {
+		return nil, err
+	}
+	if shipment == nil {
+		return nil, fmt.Errorf("The shipment %s does not exist", shipmentID)
+	}
+	return shipment, nil
+}
+
+// QueryProductShipment resolves the shipment the product is currently packed in, following
+// cartons and pallets up to the outermost container.
+func (s *QueryContract) QueryProductShipment(ctx contractapi.TransactionContextInterface, productID string) (*ShipmentTrace, error) {
+	product, err := readProduct(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	if product.ShipmentID == "" {
+		return nil, fmt.Errorf("The product %s is not in a shipment", productID)
+	}
+
+	trace := &ShipmentTrace{ProductID: productID}
+	for containerID := product.ShipmentID; containerID != ""; {
+		shipment, err := s.QueryShipment(ctx, containerID)
+		if err != nil {
+			return nil, err
+		}
+		trace.ContainerPath = append(trace.ContainerPath, containerID)
+		trace.Shipment = shipment
+		containerID = shipment.ParentID
+	}
+	return trace, nil
+}
+
+// walkShipment calls visit for every product in the container and its nested containers, then
+// for the container itself with a nil product.
+func walkShipment(ctx contractapi.TransactionContextInterface, container *Shipment, visit func(*Shipment, *Product) error) error {
+	for _, productID := range container.ProductIDs {
+		product, err := readProduct(ctx, productID)
+		if err != nil {
+			return err
+		}
+		if err := visit(container, product); err != nil {
+			return err
+		}
+	}
+	for _, childID := range container.ChildIDs {
+		child, err := readShipment(ctx, childID)
+		if err != nil {
+			return err
+		}
+		if child == nil {
+			return fmt.Errorf("The shipment %s does not exist", childID)
+		}
+		if err := walkShipment(ctx, child, visit); err != nil {
+			return err
+		}
+	}
+	return visit(container, nil)
+}
+
+func readShipment(ctx contractapi.TransactionContextInterface, shipmentID string) (*Shipment, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(shipmentObjectType, []string{shipmentID})
+	if err != nil {
+		return nil, err
+	}
+	shipmentJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	if shipmentJSON == nil {
+		return nil, nil
+	}
+
+	var shipment Shipment
+	err = json.Unmarshal(shipmentJSON, &shipment)
+	if err != nil {
+		return nil, err
+	}
+	return &shipment, nil
+}
+
+func putShipment(ctx contractapi.TransactionContextInterface, shipment *Shipment) error {
+	shipmentJSON, err := json.Marshal(shipment)
+	if err != nil {
+		return err
+	}
+	key, err := ctx.GetStub().CreateCompositeKey(shipmentObjectType, []string{shipment.ID})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(key, shipmentJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	return nil
+}
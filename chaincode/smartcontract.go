@@ -6,23 +6,37 @@ import (
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 )
 
-// SmartContract provides functions for managing a Product
-type SmartContract struct {
-	contractapi.Contract
-}
-
 type Product struct {
-	ID          string    `json:"ID"`
-	ModelID     string    `json:"modelID"`
-	ModelName   string    `json:"modelName"`
-	Make        string    `json:"make"`
-	Status      int       `json:"status"`
-	UpdatedAt   string `json:"updatedAt"`
-	Description string       `json:"description"`
+	ID             string         `json:"ID"`
+	ModelID        string         `json:"modelID"`
+	ModelName      string         `json:"modelName"`
+	Make           string         `json:"make"`
+	Status         int            `json:"status"`
+	UpdatedAt      string         `json:"updatedAt"`
+	Description    string         `json:"description"`
+	Owner          string         `json:"owner,omitempty" metadata:"owner,optional"`
+	Stolen         bool           `json:"stolen,omitempty" metadata:"stolen,optional"`
+	Firmware       string         `json:"firmware,omitempty" metadata:"firmware,optional"`
+	SoldAt         string         `json:"soldAt,omitempty" metadata:"soldAt,optional"`
+	WarrantyUntil  string         `json:"warrantyUntil,omitempty" metadata:"warrantyUntil,optional"`
+	ActivatedAt    string         `json:"activatedAt,omitempty" metadata:"activatedAt,optional"`
+	ActivatedBy    string         `json:"activatedBy,omitempty" metadata:"activatedBy,optional"`
+	RMAID          string         `json:"rmaID,omitempty" metadata:"rmaID,optional"`
+	ShipmentID     string         `json:"shipmentID,omitempty" metadata:"shipmentID,optional"`
+	Location       *Location      `json:"location,omitempty" metadata:"location,optional"`
+	SGTIN          *SGTIN         `json:"sgtin,omitempty" metadata:"sgtin,optional"`
+	Condition      string         `json:"condition,omitempty" metadata:"condition,optional"`
+	Refurbishment  *Refurbishment `json:"refurbishment,omitempty" metadata:"refurbishment,optional"`
+	ParentID       string         `json:"parentID,omitempty" metadata:"parentID,optional"`
+	Components     []string       `json:"components,omitempty" metadata:"components,optional"`
+	EndOfLife      *EndOfLife     `json:"endOfLife,omitempty" metadata:"endOfLife,optional"`
+	LastModifiedBy *Modifier      `json:"lastModifiedBy,omitempty" metadata:"lastModifiedBy,optional"`
+	LastTxID       string         `json:"lastTxID,omitempty" metadata:"lastTxID,optional"`
+	SchemaVersion  int            `json:"schemaVersion"`
 }
 
 // InitLedger adds a base set of products to the ledger
-func (s *SmartContract) InitLedger(ctx contractapi.TransactionContextInterface) error {
+func (s *ProductContract) InitLedger(ctx contractapi.TransactionContextInterface) error {
 	products := []Product{
 		{ID: "PRODUCT-00001", ModelID: "MODEL-00001", ModelName: "GalaxyS7", Make: "SAMSUNG", Status: 1, UpdatedAt: "2020-06-08", Description: "등록"},
 		{ID: "PRODUCT-00002", ModelID: "MODEL-00002", ModelName: "GalaxyS9", Make: "SAMSUNG", Status: 1, UpdatedAt: "2020-06-08", Description: "등록"},
@@ -33,15 +47,15 @@ func (s *SmartContract) InitLedger(ctx contractapi.TransactionContextInterface)
 		{ID: "PRODUCT-00007", ModelID: "MODEL-00007", ModelName: "GalaxyS20", Make: "SAMSUNG", Status: 1, UpdatedAt: "2020-06-08", Description: "등록"},
 	}
 
-	for _, product := range products {
-		productJSON, err := json.Marshal(product)
-		if err != nil {
-			return err
-		}
+	owner, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
 
-		err = ctx.GetStub().PutState(product.ID, productJSON)
-		if err != nil {
-			return fmt.Errorf("Failed to put to world state. %v", err)
+	for i := range products {
+		products[i].Owner = owner
+		if err := putProduct(ctx, &products[i]); err != nil {
+			return err
 		}
 	}
 
@@ -50,7 +64,12 @@ func (s *SmartContract) InitLedger(ctx contractapi.TransactionContextInterface)
 }
 
 // QueryProduct returns the product stored in the world state with given id.
-func (s *SmartContract) QueryProduct(ctx contractapi.TransactionContextInterface, id string) (*Product, error) {
+func (s *QueryContract) QueryProduct(ctx contractapi.TransactionContextInterface, id string) (*Product, error) {
+	return readProduct(ctx, id)
+}
+
+// readProduct loads the product with given id from the world state.
+func readProduct(ctx contractapi.TransactionContextInterface, id string) (*Product, error) {
 	productJSON, err := ctx.GetStub().GetState(id)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to read from world state: %v", err)
@@ -59,17 +78,37 @@ func (s *SmartContract) QueryProduct(ctx contractapi.TransactionContextInterface
 		return nil, fmt.Errorf("The product %s does not exist", id)
 	}
 
-	var product Product
-	err = json.Unmarshal(productJSON, &product)
+	return unmarshalProduct(productJSON)
+}
+
+// putProduct writes the product to the world state under its ID, stamped with the invoker, counts
+// it in the product stats and keeps its endorsement policy in line with its owner.
+func putProduct(ctx contractapi.TransactionContextInterface, product *Product) error {
+	if err := stampProduct(ctx, product); err != nil {
+		return err
+	}
+	product.SchemaVersion = productSchemaVersion
+	if err := recordProductStats(ctx, product.ID, product); err != nil {
+		return err
+	}
+	productJSON, err := json.Marshal(product)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &product, nil
+	err = ctx.GetStub().PutState(product.ID, productJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	if err := syncEndorsementPolicy(ctx, product); err != nil {
+		return err
+	}
+	markProductChanged(ctx, product.ID)
+	return nil
 }
 
 // In CouchDB,QueryProduct returns the product stored in the world state with given id.
-func (s *SmartContract) QueryProductCouchDB(ctx contractapi.TransactionContextInterface, query string) ([]*Product, error) {
+func (s *QueryContract) QueryProductCouchDB(ctx contractapi.TransactionContextInterface, query string) ([]*Product, error) {
 	resultsIterator, err := ctx.GetStub().GetQueryResult(query)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to read from world state: %v", err)
@@ -87,18 +126,17 @@ func (s *SmartContract) QueryProductCouchDB(ctx contractapi.TransactionContextIn
 			return nil, err
 		}
 
-		var product Product
-		err = json.Unmarshal(queryResponse.Value, &product)
+		product, err := unmarshalProduct(queryResponse.Value)
 		if err != nil {
 			return nil, err
 		}
-		products = append(products, &product)
+		products = append(products, product)
 	}
 	return products, nil
 }
 
 // QueryAllProducts returns all products found in world state
-func (s *SmartContract) QueryAllProducts(ctx contractapi.TransactionContextInterface) ([]*Product, error) {
+func (s *QueryContract) QueryAllProducts(ctx contractapi.TransactionContextInterface) ([]*Product, error) {
 	// range query with empty string for startKey and endKey does an
 	// open-ended query of all products in the chaincode namespace.
 	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
@@ -114,69 +152,136 @@ func (s *SmartContract) QueryAllProducts(ctx contractapi.TransactionContextInter
 			return nil, err
 		}
 
-		var product Product
-		err = json.Unmarshal(queryResponse.Value, &product)
+		product, err := unmarshalProduct(queryResponse.Value)
 		if err != nil {
 			return nil, err
 		}
-		products = append(products, &product)
+		products = append(products, product)
 	}
 
 	return products, nil
 }
 
-// AddProduct issues a new product to the world state with given details.
-func (s *SmartContract) AddProduct(ctx contractapi.TransactionContextInterface, id string, modelID string, modelName string, make string, status int, updatedAt string, description string) error {
-	exists, err := s.ProductExists(ctx, id)
+// AddProduct issues a new product to the world state with given details. Statuses set by a
+// lifecycle transaction, such as a sale, cannot be given here.
+func (s *ProductContract) AddProduct(ctx contractapi.TransactionContextInterface, id string, modelID string, modelName string, make string, status int, updatedAt string, description string) error {
+	exists, err := productExists(ctx, id)
 	if err != nil {
 		return err
 	}
 	if exists {
 		return fmt.Errorf("The product %s already exists", id)
 	}
-
-	product := Product{
-		ID:    id,
-		ModelID:  modelID,
-		ModelName: modelName,
-		Make: make,
-		Status: status,
-		UpdatedAt: updatedAt,
-		Description: description,
+	if err := assertManualStatus(status); err != nil {
+		return err
+	}
+	if err := validateProductFields(ctx, status, make, description); err != nil {
+		return err
 	}
 
-	productJSON, err := json.Marshal(product)
+	owner, err := clientMSPID(ctx)
 	if err != nil {
 		return err
 	}
-	err = ctx.GetStub().PutState(id, productJSON)
-	if err != nil {
-		return fmt.Errorf("Failed to put to world state. %v", err)
+
+	product := Product{
+		ID:          id,
+		ModelID:     modelID,
+		ModelName:   modelName,
+		Make:        make,
+		Status:      status,
+		UpdatedAt:   updatedAt,
+		Description: description,
+		Owner:       owner,
 	}
-	return nil
+
+	return putProduct(ctx, &product)
 }
 
-// UpdateProduct updates the requested field of product with given id in world state.
-func (s *SmartContract) UpdateProduct(ctx contractapi.TransactionContextInterface, id string, status int, updatedAt string, description string) error {
-	product, err := s.QueryProduct(ctx, id)
+// UpdateProduct updates the requested field of product with given id in world state. Only the
+// owner may update it, and only to a status no lifecycle transaction manages.
+func (s *ProductContract) UpdateProduct(ctx contractapi.TransactionContextInterface, id string, status int, updatedAt string, description string) error {
+	product, err := readProduct(ctx, id)
 	if err != nil {
 		return err
 	}
+	if err := assertOwner(ctx, product); err != nil {
+		return err
+	}
+	if isEndOfLife(product.Status) {
+		return fmt.Errorf("The product %s has reached end of life", id)
+	}
+	if status != product.Status {
+		if err := assertManualStatus(status); err != nil {
+			return err
+		}
+	}
+	if err := validateProductFields(ctx, status, product.Make, description); err != nil {
+		return err
+	}
+	if err := validateStatusTransition(ctx, product.Status, status); err != nil {
+		return err
+	}
 
 	product.Status = status
 	product.UpdatedAt = updatedAt
 	product.Description = description
 
-	productJSON, err := json.Marshal(product)
+	return putProduct(ctx, product)
+}
+
+// ReportStolen flags the product with given id and every component installed in it as stolen.
+func (s *ProductContract) ReportStolen(ctx contractapi.TransactionContextInterface, id string) error {
+	product, err := readProduct(ctx, id)
 	if err != nil {
 		return err
 	}
+	if err := assertOwner(ctx, product); err != nil {
+		return err
+	}
 
-	return ctx.GetStub().PutState(id, productJSON)
+	return setStolen(ctx, product, true)
+}
+
+// RecoverStolen clears the stolen flag of the product with given id and its components.
+func (s *ProductContract) RecoverStolen(ctx contractapi.TransactionContextInterface, id string) error {
+	product, err := readProduct(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := assertOwner(ctx, product); err != nil {
+		return err
+	}
+
+	return setStolen(ctx, product, false)
+}
+
+// setStolen writes the stolen flag to the product and, recursively, to its components.
+func setStolen(ctx contractapi.TransactionContextInterface, product *Product, stolen bool) error {
+	product.Stolen = stolen
+	if err := putProduct(ctx, product); err != nil {
+		return err
+	}
+
+	for _, componentID := range product.Components {
+		component, err := readProduct(ctx, componentID)
+		if err != nil {
+			return err
+		}
+		if err := setStolen(ctx, component, stolen); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // ProductExists returns true when product with given ID exists in world state
-func (s *SmartContract) ProductExists(ctx contractapi.TransactionContextInterface, id string) (bool, error) {
+func (s *QueryContract) ProductExists(ctx contractapi.TransactionContextInterface, id string) (bool, error) {
+	return productExists(ctx, id)
+}
+
+// productExists reports whether a product with given ID is stored in the world state.
+func productExists(ctx contractapi.TransactionContextInterface, id string) (bool, error) {
 	productJSON, err := ctx.GetStub().GetState(id)
 	if err != nil {
 		return false, fmt.Errorf("Failed to read from world state: %v", err)
@@ -186,7 +291,7 @@ func (s *SmartContract) ProductExists(ctx contractapi.TransactionContextInterfac
 }
 
 // queryHistoryProducts
-func (s *SmartContract) QueryHistoryProducts(ctx contractapi.TransactionContextInterface, id string) ([]*Product, error) {
+func (s *QueryContract) QueryHistoryProducts(ctx contractapi.TransactionContextInterface, id string) ([]*Product, error) {
 
 	historyIer, error := ctx.GetStub().GetHistoryForKey(id)
 
@@ -197,32 +302,72 @@ func (s *SmartContract) QueryHistoryProducts(ctx contractapi.TransactionContextI
 	var products []*Product
 	for historyIer.HasNext() {
 		queryResponse, err := historyIer.Next()
-		var product Product
+		var product *Product
 		if err != nil {
 			return nil, err
 		}
 		if queryResponse.IsDelete {
 			continue
 		} else {
-			err = json.Unmarshal(queryResponse.Value, &product)
+			product, err = unmarshalProduct(queryResponse.Value)
 			if err != nil {
 				return nil, err
 			}
 		}
 
-		products = append(products, &product)
+		products = append(products, product)
 	}
 
 	return products, nil
 }
 
 // deleteProduct
-func (s *SmartContract) DeleteProduct(ctx contractapi.TransactionContextInterface, id string) error {
+func (s *ProductContract) DeleteProduct(ctx contractapi.TransactionContextInterface, id string) error {
 
-	_, err := s.QueryProduct(ctx, id)
+	product, err := readProduct(ctx, id)
 	if err != nil {
 		return err
 	}
+	if product.ParentID != "" {
+		return fmt.Errorf("The product %s is installed in %s", id, product.ParentID)
+	}
+	if len(product.Components) > 0 {
+		return fmt.Errorf("The product %s still has components attached", id)
+	}
+	if product.EndOfLife != nil || isEndOfLife(product.Status) {
+		return fmt.Errorf("The product %s is in the end-of-life flow and cannot be deleted", id)
+	}
+	if product.ShipmentID != "" {
+		return fmt.Errorf("The product %s is packed in shipment %s", id, product.ShipmentID)
+	}
+	if product.RMAID != "" {
+		rma, err := readRMA(ctx, product.RMAID)
+		if err != nil {
+			return err
+		}
+		if rma != nil && rmaIsOpen(rma) {
+			return fmt.Errorf("The product %s has the open RMA %s", id, product.RMAID)
+		}
+	}
 
+	if product.SGTIN != nil {
+		key, err := ctx.GetStub().CreateCompositeKey(sgtinObjectType, []string{product.SGTIN.GTIN, product.SGTIN.Serial})
+		if err != nil {
+			return err
+		}
+		if err := ctx.GetStub().DelState(key); err != nil {
+			return err
+		}
+	}
+	if err := recordDeletion(ctx, id); err != nil {
+		return err
+	}
+	if err := deleteEndorsementOverride(ctx, id); err != nil {
+		return err
+	}
+	if err := recordProductStats(ctx, id, nil); err != nil {
+		return err
+	}
+	markProductChanged(ctx, id)
 	return ctx.GetStub().DelState(id)
 }
@@ -0,0 +1,432 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	productStatsObjectType         = "productStats"
+	productStatsDeltaObjectType    = "productStatsDelta"
+	productStatsBackfillObjectType = "productStatsBackfill"
+)
+
+// ProductStats counts products by status, make and model ID. Counts stored by the compaction
+// carry when it last ran, counts returned by GetProductStats how many deltas are not compacted yet
+// and whether the backfill has counted every product.
+type ProductStats struct {
+	Total         int            `json:"total"`
+	ByStatus      map[string]int `json:"byStatus"`
+	ByMake        map[string]int `json:"byMake"`
+	ByModel       map[string]int `json:"byModel"`
+	PendingDeltas int            `json:"pendingDeltas,omitempty" metadata:"pendingDeltas,optional"`
+	CompactedAt   string         `json:"compactedAt,omitempty" metadata:"compactedAt,optional"`
+	Backfilled    bool           `json:"backfilled,omitempty" metadata:"backfilled,optional"`
+}
+
+// StatsBackfill tracks the one-off counting of the products that existed before the product
+// stats, across transactions. Products are counted in key order, and writes only change the counts
+// of products the backfill has passed.
+type StatsBackfill struct {
+	NextKey   string `json:"nextKey,omitempty" metadata:"nextKey,optional"`
+	Done      bool   `json:"done"`
+	Scanned   int    `json:"scanned"`
+	StartedAt string `json:"startedAt"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+func newProductStats() *ProductStats {
+	return &ProductStats{ByStatus: map[string]int{}, ByMake: map[string]int{}, ByModel: map[string]int{}}
+}
+
+// GetProductStats returns the product counts: the compacted totals plus the deltas written since.
+func (s *QueryContract) GetProductStats(ctx contractapi.TransactionContextInterface) (*ProductStats, error) {
+	stats, err := readProductStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(productStatsDeltaObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var delta ProductStats
+		err = json.Unmarshal(queryResponse.Value, &delta)
+		if err != nil {
+			return nil, err
+		}
+		stats.merge(&delta)
+		stats.PendingDeltas++
+	}
+	stats.prune()
+
+	backfill, err := readStatsBackfill(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stats.Backfilled = backfill != nil && backfill.Done
+	return stats, nil
+}
+
+// BackfillProductStats counts up to pageSize product records, continuing where the previous call
+// stopped, and returns the progress. Call it until the progress is done, after which the stats
+// count every product; until then GetProductStats reports them as not backfilled.
+func (s *AdminContract) BackfillProductStats(ctx contractapi.TransactionContextInterface, pageSize int) (*StatsBackfill, error) {
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("The page size must be positive")
+	}
+	pending := pendingStatsOf(ctx)
+	backfill, err := pending.readBackfill(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if backfill == nil {
+		backfill = &StatsBackfill{StartedAt: now}
+	}
+	if backfill.Done {
+		return backfill, nil
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByRange(backfill.NextKey, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	backfill.NextKey = ""
+	for page := 0; resultsIterator.HasNext(); page++ {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if page == pageSize {
+			backfill.NextKey = queryResponse.Key
+			break
+		}
+		backfill.Scanned++
+		pending.delta.add(countedProduct(queryResponse.Value), 1)
+	}
+	backfill.Done = backfill.NextKey == ""
+	backfill.UpdatedAt = now
+
+	backfillJSON, err := json.Marshal(backfill)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ctx.GetStub().CreateCompositeKey(productStatsBackfillObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	err = ctx.GetStub().PutState(key, backfillJSON)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	pending.backfill = backfill
+	if err := pending.putDelta(ctx); err != nil {
+		return nil, err
+	}
+	return backfill, nil
+}
+
+// CompactProductStats folds up to limit deltas into the stored totals and deletes them, returning
+// the totals with the number of deltas left. Writers add deltas concurrently, so a compaction may
+// fail on a read conflict and should then be retried.
+func (s *AdminContract) CompactProductStats(ctx contractapi.TransactionContextInterface, limit int) (*ProductStats, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("The limit must be positive")
+	}
+	stats, err := readProductStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(productStatsDeltaObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	compacted := 0
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if compacted == limit {
+			stats.PendingDeltas++
+			continue
+		}
+
+		var delta ProductStats
+		err = json.Unmarshal(queryResponse.Value, &delta)
+		if err != nil {
+			return nil, err
+		}
+		stats.merge(&delta)
+		if err := ctx.GetStub().DelState(queryResponse.Key); err != nil {
+			return nil, err
+		}
+		compacted++
+	}
+	stats.prune()
+	stats.CompactedAt, err = txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := stats.PendingDeltas
+	stats.PendingDeltas = 0
+	statsJSON, err := json.Marshal(stats)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ctx.GetStub().CreateCompositeKey(productStatsObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	err = ctx.GetStub().PutState(key, statsJSON)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	stats.PendingDeltas = pending
+	return stats, nil
+}
+
+// add counts the product n times, or does nothing for a nil product.
+func (stats *ProductStats) add(product *Product, n int) {
+	if product == nil {
+		return
+	}
+	stats.Total += n
+	stats.ByStatus[strconv.Itoa(product.Status)] += n
+	stats.ByMake[product.Make] += n
+	stats.ByModel[product.ModelID] += n
+}
+
+func (stats *ProductStats) merge(other *ProductStats) {
+	stats.Total += other.Total
+	for _, counts := range []struct{ into, from map[string]int }{
+		{stats.ByStatus, other.ByStatus},
+		{stats.ByMake, other.ByMake},
+		{stats.ByModel, other.ByModel},
+	} {
+		for value, n := range counts.from {
+			counts.into[value] += n
+		}
+	}
+}
+
+// isZero reports whether the stats change no count.
+func (stats *ProductStats) isZero() bool {
+	if stats.Total != 0 {
+		return false
+	}
+	for _, counts := range []map[string]int{stats.ByStatus, stats.ByMake, stats.ByModel} {
+		for _, n := range counts {
+			if n != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// prune drops the values no product has any more.
+func (stats *ProductStats) prune() {
+	for _, counts := range []map[string]int{stats.ByStatus, stats.ByMake, stats.ByModel} {
+		for value, n := range counts {
+			if n == 0 {
+				delete(counts, value)
+			}
+		}
+	}
+}
+
+// pendingStats accumulates the count changes of a transaction, which go to a single delta key
+// so that concurrent transactions never write the same key.
+type pendingStats struct {
+	delta *ProductStats
+	// written holds the last product written per ID, nil once deleted, since the stub does not
+	// return the transaction's own writes
+	written map[string]*Product
+	// stored reports whether the delta key holds the delta
+	stored bool
+	// backfill is the backfill progress once read
+	backfill       *StatsBackfill
+	backfillLoaded bool
+}
+
+func newPendingStats() *pendingStats {
+	return &pendingStats{delta: newProductStats(), written: map[string]*Product{}}
+}
+
+func (pending *pendingStats) clone() *pendingStats {
+	cloned := newPendingStats()
+	cloned.delta.merge(pending.delta)
+	for id, product := range pending.written {
+		cloned.written[id] = product
+	}
+	cloned.stored = pending.stored
+	cloned.backfill = pending.backfill
+	cloned.backfillLoaded = pending.backfillLoaded
+	return cloned
+}
+
+// readBackfill returns the backfill progress, reading it once per transaction.
+func (pending *pendingStats) readBackfill(ctx contractapi.TransactionContextInterface) (*StatsBackfill, error) {
+	if !pending.backfillLoaded {
+		backfill, err := readStatsBackfill(ctx)
+		if err != nil {
+			return nil, err
+		}
+		pending.backfill = backfill
+		pending.backfillLoaded = true
+	}
+	return pending.backfill, nil
+}
+
+// counts reports whether the product with given id is counted, which it is once the backfill has
+// passed its key.
+func (pending *pendingStats) counts(ctx contractapi.TransactionContextInterface, id string) (bool, error) {
+	backfill, err := pending.readBackfill(ctx)
+	if err != nil {
+		return false, err
+	}
+	return backfill != nil && (backfill.Done || id < backfill.NextKey), nil
+}
+
+// putDelta writes the transaction's delta, or removes it again when it no longer changes any count.
+func (pending *pendingStats) putDelta(ctx contractapi.TransactionContextInterface) error {
+	key, err := ctx.GetStub().CreateCompositeKey(productStatsDeltaObjectType, []string{ctx.GetStub().GetTxID()})
+	if err != nil {
+		return err
+	}
+	if pending.delta.isZero() {
+		if !pending.stored {
+			return nil
+		}
+		pending.stored = false
+		return ctx.GetStub().DelState(key)
+	}
+
+	deltaJSON, err := json.Marshal(pending.delta)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(key, deltaJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to put to world state. %v", err)
+	}
+	pending.stored = true
+	return nil
+}
+
+// pendingStatsOf returns the pending stats of the transaction. Contexts that do not carry them get
+// fresh ones, which is only correct while the transaction writes each product once.
+func pendingStatsOf(ctx contractapi.TransactionContextInterface) *pendingStats {
+	switch c := ctx.(type) {
+	case *TransactionContext:
+		if c.stats == nil {
+			c.stats = newPendingStats()
+		}
+		return c.stats
+	case *stagedContext:
+		return c.stats
+	}
+	return newPendingStats()
+}
+
+// recordProductStats moves the product with given id from the counts of its previous state to
+// those of the product about to be written, or out of the counts when product is nil, and writes
+// the transaction's delta. Products the backfill has not reached yet are left to it.
+func recordProductStats(ctx contractapi.TransactionContextInterface, id string, product *Product) error {
+	pending := pendingStatsOf(ctx)
+	counted, err := pending.counts(ctx, id)
+	if err != nil || !counted {
+		return err
+	}
+	previous, ok := pending.written[id]
+	if !ok {
+		productJSON, err := ctx.GetStub().GetState(id)
+		if err != nil {
+			return fmt.Errorf("Failed to read from world state: %v", err)
+		}
+		previous = countedProduct(productJSON)
+	}
+	if product != nil {
+		written := *product
+		product = &written
+	}
+	pending.delta.add(previous, -1)
+	pending.delta.add(product, 1)
+	pending.written[id] = product
+	return pending.putDelta(ctx)
+}
+
+// countedProduct returns the product a stored record holds, or nil when it holds none.
+func countedProduct(productJSON []byte) *Product {
+	if productJSON == nil {
+		return nil
+	}
+	product, err := unmarshalProduct(productJSON)
+	if err != nil {
+		return nil
+	}
+	return product
+}
+
+func readProductStats(ctx contractapi.TransactionContextInterface) (*ProductStats, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(productStatsObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	statsJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	stats := newProductStats()
+	if statsJSON == nil {
+		return stats, nil
+	}
+
+	err = json.Unmarshal(statsJSON, stats)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func readStatsBackfill(ctx contractapi.TransactionContextInterface) (*StatsBackfill, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(productStatsBackfillObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	backfillJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read from world state: %v", err)
+	}
+	if backfillJSON == nil {
+		return nil, nil
+	}
+
+	var backfill StatsBackfill
+	err = json.Unmarshal(backfillJSON, &backfill)
+	if err != nil {
+		return nil, err
+	}
+	return &backfill, nil
+}
@@ -0,0 +1,45 @@
+package chaincode
+
+import "fmt"
+
+// Product status codes stored in Product.Status
+const (
+	StatusRegistered  = 1
+	StatusRecalled    = 2
+	StatusSold        = 3
+	StatusActivated   = 4
+	StatusReturned    = 5
+	StatusScrapped    = 6
+	StatusRefurbished = 7
+	StatusInTransit   = 8
+
+	StatusCollectedForRecycling = 9
+	StatusDismantled            = 10
+	StatusDestroyed             = 11
+)
+
+// isEndOfLife reports whether the status is one of the terminal recycling statuses, which block
+// any further transfer or sale.
+func isEndOfLife(status int) bool {
+	return status == StatusCollectedForRecycling || status == StatusDismantled || status == StatusDestroyed
+}
+
+// lifecycleStatuses maps the statuses that only a lifecycle transaction may set to that transaction
+var lifecycleStatuses = map[int]string{
+	StatusSold:                  "SellProduct",
+	StatusActivated:             "ActivateDevice",
+	StatusReturned:              "ReceiveRMA",
+	StatusRefurbished:           "RefurbishProduct",
+	StatusInTransit:             "DispatchShipment",
+	StatusCollectedForRecycling: "CollectForRecycling",
+	StatusDismantled:            "RecordDismantling",
+	StatusDestroyed:             "CertifyDestruction",
+}
+
+// assertManualStatus rejects a status that AddProduct or UpdateProduct may not set directly.
+func assertManualStatus(status int) error {
+	if transaction, ok := lifecycleStatuses[status]; ok {
+		return fmt.Errorf("The status %d can only be set through %s", status, transaction)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package credential
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// multibaseBase58 is the multibase prefix of base58btc, the encoding of Data Integrity proof values
+const multibaseBase58 = 'z'
+
+func encodeMultibase(data []byte) string {
+	n := new(big.Int).SetBytes(data)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	// every leading zero byte is written as the zero digit
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(multibaseBase58) + string(out)
+}
+
+func decodeMultibase(encoded string) ([]byte, error) {
+	if encoded == "" || encoded[0] != multibaseBase58 {
+		return nil, fmt.Errorf("The value is not multibase base58btc encoded")
+	}
+	encoded = encoded[1:]
+
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	for _, c := range encoded {
+		digit := strings.IndexRune(base58Alphabet, c)
+		if digit < 0 {
+			return nil, fmt.Errorf("The character %q is not base58", c)
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(digit)))
+	}
+
+	zeros := 0
+	for zeros < len(encoded) && encoded[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
@@ -0,0 +1,442 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package credential
+
+// Documents the verifier resolves without network access
+const (
+	CredentialsContextURL = "https://www.w3.org/ns/credentials/v2"
+	ProductContextURL     = "urn:fabcar:contexts:product-provenance:v1"
+	ProductSchemaURL      = "urn:fabcar:schemas:product-provenance:v1"
+)
+
+// documents maps the URL of every embedded context and schema to its content.
+var documents = map[string]string{
+	CredentialsContextURL: credentialsContext,
+	ProductContextURL:     productContext,
+	ProductSchemaURL:      productSchema,
+}
+
+// Document returns the embedded context or schema published at the URL, so that JSON-LD
+// processors can load it offline.
+func Document(url string) (string, bool) {
+	document, ok := documents[url]
+	return document, ok
+}
+
+// credentialsContext is the W3C Verifiable Credentials 2.0 context as published at its URL, which
+// the specification expects verifiers to hold locally rather than fetch.
+const credentialsContext = `{
+  "@context": {
+    "@protected": true,
+
+    "id": "@id",
+    "type": "@type",
+
+    "description": "https://schema.org/description",
+    "digestMultibase": {
+      "@id": "https://w3id.org/security#digestMultibase",
+      "@type": "https://w3id.org/security#multibase"
+    },
+    "digestSRI": {
+      "@id": "https://www.w3.org/2018/credentials#digestSRI",
+      "@type": "https://www.w3.org/2018/credentials#sriString"
+    },
+    "mediaType": {
+      "@id": "https://schema.org/encodingFormat"
+    },
+    "name": "https://schema.org/name",
+
+    "VerifiableCredential": {
+      "@id": "https://www.w3.org/2018/credentials#VerifiableCredential",
+      "@context": {
+        "@protected": true,
+
+        "id": "@id",
+        "type": "@type",
+
+        "confidenceMethod": {
+          "@id": "https://www.w3.org/2018/credentials#confidenceMethod",
+          "@type": "@id"
+        },
+        "credentialSchema": {
+          "@id": "https://www.w3.org/2018/credentials#credentialSchema",
+          "@type": "@id"
+        },
+        "credentialStatus": {
+          "@id": "https://www.w3.org/2018/credentials#credentialStatus",
+          "@type": "@id"
+        },
+        "credentialSubject": {
+          "@id": "https://www.w3.org/2018/credentials#credentialSubject",
+          "@type": "@id"
+        },
+        "description": "https://schema.org/description",
+        "evidence": {
+          "@id": "https://www.w3.org/2018/credentials#evidence",
+          "@type": "@id"
+        },
+        "issuer": {
+          "@id": "https://www.w3.org/2018/credentials#issuer",
+          "@type": "@id"
+        },
+        "name": "https://schema.org/name",
+        "proof": {
+          "@id": "https://w3id.org/security#proof",
+          "@type": "@id",
+          "@container": "@graph"
+        },
+        "refreshService": {
+          "@id": "https://www.w3.org/2018/credentials#refreshService",
+          "@type": "@id"
+        },
+        "relatedResource": {
+          "@id": "https://www.w3.org/2018/credentials#relatedResource",
+          "@type": "@id"
+        },
+        "renderMethod": {
+          "@id": "https://www.w3.org/2018/credentials#renderMethod",
+          "@type": "@id"
+        },
+        "termsOfUse": {
+          "@id": "https://www.w3.org/2018/credentials#termsOfUse",
+          "@type": "@id"
+        },
+        "validFrom": {
+          "@id": "https://www.w3.org/2018/credentials#validFrom",
+          "@type": "http://www.w3.org/2001/XMLSchema#dateTime"
+        },
+        "validUntil": {
+          "@id": "https://www.w3.org/2018/credentials#validUntil",
+          "@type": "http://www.w3.org/2001/XMLSchema#dateTime"
+        }
+      }
+    },
+
+    "EnvelopedVerifiableCredential":
+      "https://www.w3.org/2018/credentials#EnvelopedVerifiableCredential",
+
+    "VerifiablePresentation": {
+      "@id": "https://www.w3.org/2018/credentials#VerifiablePresentation",
+      "@context": {
+        "@protected": true,
+
+        "id": "@id",
+        "type": "@type",
+
+        "holder": {
+          "@id": "https://www.w3.org/2018/credentials#holder",
+          "@type": "@id"
+        },
+        "proof": {
+          "@id": "https://w3id.org/security#proof",
+          "@type": "@id",
+          "@container": "@graph"
+        },
+        "termsOfUse": {
+          "@id": "https://www.w3.org/2018/credentials#termsOfUse",
+          "@type": "@id"
+        },
+        "verifiableCredential": {
+          "@id": "https://www.w3.org/2018/credentials#verifiableCredential",
+          "@type": "@id",
+          "@container": "@graph",
+          "@context": null
+        }
+      }
+    },
+
+    "EnvelopedVerifiablePresentation":
+      "https://www.w3.org/2018/credentials#EnvelopedVerifiablePresentation",
+
+    "JsonSchemaCredential":
+      "https://www.w3.org/2018/credentials#JsonSchemaCredential",
+
+    "JsonSchema": {
+      "@id": "https://www.w3.org/2018/credentials#JsonSchema",
+      "@context": {
+        "@protected": true,
+
+        "id": "@id",
+        "type": "@type",
+
+        "jsonSchema": {
+          "@id": "https://www.w3.org/2018/credentials#jsonSchema",
+          "@type": "@json"
+        }
+      }
+    },
+
+    "BitstringStatusListCredential":
+      "https://www.w3.org/ns/credentials/status#BitstringStatusListCredential",
+
+    "BitstringStatusList": {
+      "@id": "https://www.w3.org/ns/credentials/status#BitstringStatusList",
+      "@context": {
+        "@protected": true,
+
+        "id": "@id",
+        "type": "@type",
+
+        "encodedList": {
+          "@id": "https://www.w3.org/ns/credentials/status#encodedList",
+          "@type": "https://w3id.org/security#multibase"
+        },
+        "statusMessage": {
+          "@id": "https://www.w3.org/ns/credentials/status#statusMessage",
+          "@context": {
+            "@protected": true,
+
+            "id": "@id",
+            "type": "@type",
+
+            "message": "https://www.w3.org/ns/credentials/status#message",
+            "status": "https://www.w3.org/ns/credentials/status#status"
+          }
+        },
+        "statusPurpose":
+          "https://www.w3.org/ns/credentials/status#statusPurpose",
+        "statusReference": {
+          "@id": "https://www.w3.org/ns/credentials/status#statusReference",
+          "@type": "@id"
+        },
+        "statusSize": {
+          "@id": "https://www.w3.org/ns/credentials/status#statusSize",
+          "@type": "https://www.w3.org/2001/XMLSchema#positiveInteger"
+        },
+        "ttl": "https://www.w3.org/ns/credentials/status#ttl"
+      }
+    },
+
+    "BitstringStatusListEntry": {
+      "@id":
+        "https://www.w3.org/ns/credentials/status#BitstringStatusListEntry",
+      "@context": {
+        "@protected": true,
+
+        "id": "@id",
+        "type": "@type",
+
+        "statusListCredential": {
+          "@id":
+            "https://www.w3.org/ns/credentials/status#statusListCredential",
+          "@type": "@id"
+        },
+        "statusListIndex":
+          "https://www.w3.org/ns/credentials/status#statusListIndex",
+        "statusPurpose":
+          "https://www.w3.org/ns/credentials/status#statusPurpose"
+      }
+    },
+
+    "DataIntegrityProof": {
+      "@id": "https://w3id.org/security#DataIntegrityProof",
+      "@context": {
+        "@protected": true,
+
+        "id": "@id",
+        "type": "@type",
+
+        "challenge": "https://w3id.org/security#challenge",
+        "created": {
+          "@id": "http://purl.org/dc/terms/created",
+          "@type": "http://www.w3.org/2001/XMLSchema#dateTime"
+        },
+        "cryptosuite": {
+          "@id": "https://w3id.org/security#cryptosuite",
+          "@type": "https://w3id.org/security#cryptosuiteString"
+        },
+        "domain": "https://w3id.org/security#domain",
+        "expires": {
+          "@id": "https://w3id.org/security#expiration",
+          "@type": "http://www.w3.org/2001/XMLSchema#dateTime"
+        },
+        "nonce": "https://w3id.org/security#nonce",
+        "previousProof": {
+          "@id": "https://w3id.org/security#previousProof",
+          "@type": "@id"
+        },
+        "proofPurpose": {
+          "@id": "https://w3id.org/security#proofPurpose",
+          "@type": "@vocab",
+          "@context": {
+            "@protected": true,
+
+            "id": "@id",
+            "type": "@type",
+
+            "assertionMethod": {
+              "@id": "https://w3id.org/security#assertionMethod",
+              "@type": "@id",
+              "@container": "@set"
+            },
+            "authentication": {
+              "@id": "https://w3id.org/security#authenticationMethod",
+              "@type": "@id",
+              "@container": "@set"
+            },
+            "capabilityDelegation": {
+              "@id": "https://w3id.org/security#capabilityDelegationMethod",
+              "@type": "@id",
+              "@container": "@set"
+            },
+            "capabilityInvocation": {
+              "@id": "https://w3id.org/security#capabilityInvocationMethod",
+              "@type": "@id",
+              "@container": "@set"
+            },
+            "keyAgreement": {
+              "@id": "https://w3id.org/security#keyAgreementMethod",
+              "@type": "@id",
+              "@container": "@set"
+            }
+          }
+        },
+        "proofValue": {
+          "@id": "https://w3id.org/security#proofValue",
+          "@type": "https://w3id.org/security#multibase"
+        },
+        "verificationMethod": {
+          "@id": "https://w3id.org/security#verificationMethod",
+          "@type": "@id"
+        }
+      }
+    },
+
+    "...": {
+      "@id": "https://www.iana.org/assignments/jwt#..."
+    },
+    "_sd": {
+      "@id": "https://www.iana.org/assignments/jwt#_sd",
+      "@type": "@json"
+    },
+    "_sd_alg": {
+      "@id": "https://www.iana.org/assignments/jwt#_sd_alg"
+    },
+    "aud": {
+      "@id": "https://www.iana.org/assignments/jwt#aud",
+      "@type": "@id"
+    },
+    "cnf": {
+      "@id": "https://www.iana.org/assignments/jwt#cnf",
+      "@context": {
+        "@protected": true,
+
+        "kid": {
+          "@id": "https://www.iana.org/assignments/jwk#kid",
+          "@type": "@id"
+        },
+        "jwk": {
+          "@id": "https://www.iana.org/assignments/jwt#jwk",
+          "@type": "@json"
+        }
+      }
+    },
+    "exp": {
+      "@id": "https://www.iana.org/assignments/jwt#exp",
+      "@type": "https://www.w3.org/2001/XMLSchema#nonNegativeInteger"
+    },
+    "iat": {
+      "@id": "https://www.iana.org/assignments/jwt#iat",
+      "@type": "https://www.w3.org/2001/XMLSchema#nonNegativeInteger"
+    },
+    "iss": {
+      "@id": "https://www.iana.org/assignments/jose#iss",
+      "@type": "@id"
+    },
+    "jku": {
+      "@id": "https://www.iana.org/assignments/jose#jku",
+      "@type": "@id"
+    },
+    "kid": {
+      "@id": "https://www.iana.org/assignments/jose#kid",
+      "@type": "@id"
+    },
+    "nbf": {
+      "@id": "https://www.iana.org/assignments/jwt#nbf",
+      "@type": "https://www.w3.org/2001/XMLSchema#nonNegativeInteger"
+    },
+    "sub": {
+      "@id": "https://www.iana.org/assignments/jose#sub",
+      "@type": "@id"
+    },
+    "x5u": {
+      "@id": "https://www.iana.org/assignments/jose#x5u",
+      "@type": "@id"
+    }
+  }
+}
+`
+
+// productContext maps the product provenance terms into the fabcar vocabulary.
+const productContext = `{
+  "@context": {
+    "@version": 1.1,
+    "@protected": true,
+    "@vocab": "urn:fabcar:vocab#",
+    "ProductProvenanceCredential": "urn:fabcar:vocab#ProductProvenanceCredential"
+  }
+}`
+
+// productSchema is the JSON Schema product provenance credentials are validated against.
+const productSchema = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "urn:fabcar:schemas:product-provenance:v1",
+  "title": "Product provenance credential",
+  "type": "object",
+  "required": ["@context", "id", "type", "issuer", "validFrom", "credentialSchema", "credentialSubject"],
+  "properties": {
+    "@context": {"type": "array", "items": {"type": "string"}},
+    "id": {"type": "string"},
+    "type": {"type": "array", "items": {"type": "string"}, "contains": {"const": "ProductProvenanceCredential"}},
+    "issuer": {"type": "string"},
+    "validFrom": {"type": "string"},
+    "credentialSchema": {
+      "type": "object",
+      "required": ["id", "type"],
+      "properties": {"id": {"type": "string"}, "type": {"const": "JsonSchema"}}
+    },
+    "credentialSubject": {
+      "type": "object",
+      "required": ["id", "product", "custody", "service"],
+      "properties": {
+        "id": {"type": "string"},
+        "product": {
+          "type": "object",
+          "required": ["ID", "modelID", "modelName", "make", "status"],
+          "properties": {
+            "ID": {"type": "string"},
+            "modelID": {"type": "string"},
+            "modelName": {"type": "string"},
+            "make": {"type": "string"},
+            "status": {"type": "integer"},
+            "owner": {"type": "string"}
+          }
+        },
+        "model": {
+          "type": "object",
+          "required": ["ID", "name", "make"],
+          "properties": {"ID": {"type": "string"}, "name": {"type": "string"}, "make": {"type": "string"}, "gtin": {"type": "string"}}
+        },
+        "custody": {
+          "type": "array",
+          "items": {
+            "type": "object",
+            "required": ["action", "handlerMSP", "recordedAt", "txID"],
+            "properties": {"action": {"type": "string"}, "handlerMSP": {"type": "string"}, "recordedAt": {"type": "string"}, "txID": {"type": "string"}}
+          }
+        },
+        "service": {
+          "type": "object",
+          "required": ["firmwareUpdates", "rmas"],
+          "properties": {
+            "firmwareUpdates": {"type": "array", "items": {"type": "object", "required": ["toVersion", "updatedAt"]}},
+            "rmas": {"type": "array", "items": {"type": "object", "required": ["ID", "state", "requestedAt"]}},
+            "refurbishment": {"type": "object", "required": ["grade", "refurbishedAt"]}
+          }
+        }
+      }
+    }
+  }
+}`
@@ -0,0 +1,298 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package credential signs and verifies product provenance credentials.
+//
+// A credential is a JSON-LD document following the W3C Verifiable Credentials 2.0 data model,
+// secured with a Data Integrity proof using the eddsa-jcs-2022 cryptosuite and a manufacturer
+// key registered on the ledger. The ledger renders the unsigned credential; the manufacturer
+// signs it with its own key, so the key never leaves it.
+// The JSON-LD contexts and the JSON Schema the credential refers to are embedded, so that a
+// credential is verified without network access:
+//
+//	keys, err := authenticity.ParseKeys(snapshot)
+//	verified, err := credential.Verify(document, keys)
+package credential
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-samples/asset-transfer-fabcar/chaincode-go/authenticity"
+)
+
+// Proof parameters of every credential
+const (
+	ProofType    = "DataIntegrityProof"
+	Cryptosuite  = "eddsa-jcs-2022"
+	ProofPurpose = "assertionMethod"
+)
+
+const (
+	issuerPrefix  = "urn:fabcar:msp:"
+	subjectPrefix = "urn:fabcar:product:"
+)
+
+// Verification errors
+var (
+	ErrMalformed     = errors.New("The credential is malformed")
+	ErrUnknownKey    = errors.New("The credential is signed with an unknown key")
+	ErrRevokedKey    = errors.New("The credential is signed with a revoked key")
+	ErrBadSignature  = errors.New("The credential proof is invalid")
+	ErrUnknownSource = errors.New("The credential refers to a context or schema that is not embedded")
+)
+
+// Verified describes a credential whose proof, contexts and schema checked out
+type Verified struct {
+	ID        string
+	Issuer    string
+	MSPID     string
+	KeyID     string
+	ProductID string
+	ValidFrom time.Time
+	Subject   map[string]interface{}
+}
+
+// IssuerID returns the issuer identifier of the organization with given MSP ID.
+func IssuerID(mspID string) string {
+	return issuerPrefix + mspID
+}
+
+// SubjectID returns the credential subject identifier of the product with given ID.
+func SubjectID(productID string) string {
+	return subjectPrefix + productID
+}
+
+// VerificationMethod returns the verification method of the key registered by the organization.
+func VerificationMethod(mspID string, keyID string) string {
+	return IssuerID(mspID) + "#" + keyID
+}
+
+// Sign adds an eddsa-jcs-2022 proof to the unsigned credential and returns the secured
+// credential in canonical form. Signing is deterministic for a given created timestamp.
+func Sign(unsigned []byte, verificationMethod string, created string, privateKey ed25519.PrivateKey) ([]byte, error) {
+	document, err := decode(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := document["proof"]; ok {
+		return nil, fmt.Errorf("The credential already has a proof")
+	}
+
+	proof := map[string]interface{}{
+		"type":               ProofType,
+		"cryptosuite":        Cryptosuite,
+		"created":            created,
+		"verificationMethod": verificationMethod,
+		"proofPurpose":       ProofPurpose,
+	}
+	if context, ok := document["@context"]; ok {
+		proof["@context"] = context
+	}
+
+	hash, err := hashData(document, proof)
+	if err != nil {
+		return nil, err
+	}
+	proof["proofValue"] = encodeMultibase(ed25519.Sign(privateKey, hash))
+	document["proof"] = proof
+
+	signed, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	return Canonicalize(signed)
+}
+
+// Verify checks the credential's proof against the key set, that it only refers to embedded
+// contexts and that it satisfies its embedded schema.
+func Verify(secured []byte, keys authenticity.KeySet) (*Verified, error) {
+	document, err := decode(secured)
+	if err != nil {
+		return nil, err
+	}
+	proof, ok := document["proof"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: no proof", ErrMalformed)
+	}
+	delete(document, "proof")
+
+	if err := checkContexts(document, proof); err != nil {
+		return nil, err
+	}
+	if !containsValue(document["type"], "VerifiableCredential") {
+		return nil, fmt.Errorf("%w: not a VerifiableCredential", ErrMalformed)
+	}
+	switch {
+	case proof["type"] != ProofType:
+		return nil, fmt.Errorf("%w: unsupported proof type %v", ErrMalformed, proof["type"])
+	case proof["cryptosuite"] != Cryptosuite:
+		return nil, fmt.Errorf("%w: unsupported cryptosuite %v", ErrMalformed, proof["cryptosuite"])
+	case proof["proofPurpose"] != ProofPurpose:
+		return nil, fmt.Errorf("%w: unsupported proof purpose %v", ErrMalformed, proof["proofPurpose"])
+	}
+
+	issuer, _ := document["issuer"].(string)
+	method, _ := proof["verificationMethod"].(string)
+	i := strings.LastIndex(method, "#")
+	if i < 0 || method[:i] != issuer || !strings.HasPrefix(issuer, issuerPrefix) {
+		return nil, fmt.Errorf("%w: the verification method %s is not controlled by the issuer %s", ErrMalformed, method, issuer)
+	}
+	mspID, keyID := strings.TrimPrefix(issuer, issuerPrefix), method[i+1:]
+
+	key, ok := keys[keyID]
+	switch {
+	case !ok:
+		return nil, ErrUnknownKey
+	case key.Revoked:
+		return nil, ErrRevokedKey
+	case key.MSPID != mspID:
+		return nil, fmt.Errorf("The key %s belongs to %s, not the issuer %s", keyID, key.MSPID, mspID)
+	}
+	publicKey, err := authenticity.DecodePublicKey(key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("The key %s is invalid: %v", keyID, err)
+	}
+
+	proofValue, _ := proof["proofValue"].(string)
+	signature, err := decodeMultibase(proofValue)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	delete(proof, "proofValue")
+	hash, err := hashData(document, proof)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(publicKey, hash, signature) {
+		return nil, ErrBadSignature
+	}
+
+	if err := checkSchema(document); err != nil {
+		return nil, err
+	}
+
+	id, _ := document["id"].(string)
+	subject, _ := document["credentialSubject"].(map[string]interface{})
+	subjectID, _ := subject["id"].(string)
+	validFrom, _ := document["validFrom"].(string)
+	validFromTime, err := time.Parse(time.RFC3339, validFrom)
+	if err != nil {
+		return nil, fmt.Errorf("%w: validFrom %q is not a date-time", ErrMalformed, validFrom)
+	}
+
+	return &Verified{
+		ID:        id,
+		Issuer:    issuer,
+		MSPID:     mspID,
+		KeyID:     keyID,
+		ProductID: strings.TrimPrefix(subjectID, subjectPrefix),
+		ValidFrom: validFromTime,
+		Subject:   subject,
+	}, nil
+}
+
+// hashData computes the eddsa-jcs-2022 hash data: the SHA-256 of the canonical proof
+// configuration followed by the SHA-256 of the canonical unsecured document.
+func hashData(document map[string]interface{}, proofConfig map[string]interface{}) ([]byte, error) {
+	canonicalProof, err := canonicalValue(proofConfig)
+	if err != nil {
+		return nil, err
+	}
+	canonicalDocument, err := canonicalValue(document)
+	if err != nil {
+		return nil, err
+	}
+
+	proofHash := sha256.Sum256(canonicalProof)
+	documentHash := sha256.Sum256(canonicalDocument)
+	return append(proofHash[:], documentHash[:]...), nil
+}
+
+// checkContexts fails unless the document starts with the credentials context,
+// every context is embedded and the proof was made over the same contexts.
+func checkContexts(document map[string]interface{}, proof map[string]interface{}) error {
+	contexts, ok := document["@context"].([]interface{})
+	if !ok || len(contexts) == 0 || contexts[0] != CredentialsContextURL {
+		return fmt.Errorf("%w: the first context must be %s", ErrMalformed, CredentialsContextURL)
+	}
+	for _, context := range contexts {
+		url, ok := context.(string)
+		if !ok {
+			return fmt.Errorf("%w: embedded context definitions are not supported", ErrMalformed)
+		}
+		if _, ok := documents[url]; !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownSource, url)
+		}
+	}
+
+	if proofContexts, ok := proof["@context"].([]interface{}); ok {
+		if len(proofContexts) > len(contexts) {
+			return fmt.Errorf("%w: the proof contexts do not match the credential", ErrMalformed)
+		}
+		for i, context := range proofContexts {
+			if contexts[i] != context {
+				return fmt.Errorf("%w: the proof contexts do not match the credential", ErrMalformed)
+			}
+		}
+	}
+	return nil
+}
+
+// checkSchema validates the document against the embedded schema named by its credentialSchema.
+func checkSchema(document map[string]interface{}) error {
+	credentialSchema, ok := document["credentialSchema"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	schemaID, _ := credentialSchema["id"].(string)
+	source, ok := documents[schemaID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownSource, schemaID)
+	}
+
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(source), &schema); err != nil {
+		return err
+	}
+	if err := validateSchema(schema, document, "credential"); err != nil {
+		return fmt.Errorf("The credential does not satisfy the schema %s: %v", schemaID, err)
+	}
+	return nil
+}
+
+func decode(data []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var document map[string]interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return document, nil
+}
+
+func canonicalValue(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return Canonicalize(data)
+}
+
+func containsValue(list interface{}, value string) bool {
+	items, _ := list.([]interface{})
+	for _, item := range items {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+package credential_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-samples/asset-transfer-fabcar/chaincode-go/authenticity"
+	"github.com/hyperledger/fabric-samples/asset-transfer-fabcar/chaincode-go/credential"
+)
+
+var (
+	manufacturerKey = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	otherKey        = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize))
+)
+
+func testKeys() authenticity.KeySet {
+	return authenticity.KeySet{
+		"key-1": {
+			KeyID:     "key-1",
+			MSPID:     "Org1MSP",
+			PublicKey: base64.StdEncoding.EncodeToString(manufacturerKey.Public().(ed25519.PublicKey)),
+		},
+	}
+}
+
+// unsigned returns a product provenance credential, changed by edit before it is signed.
+func unsigned(t *testing.T, edit func(document map[string]interface{})) []byte {
+	document := map[string]interface{}{
+		"@context":  []interface{}{credential.CredentialsContextURL, credential.ProductContextURL},
+		"id":        "urn:fabcar:credential:PRODUCT-00001:tx1",
+		"type":      []interface{}{"VerifiableCredential", "ProductProvenanceCredential"},
+		"issuer":    credential.IssuerID("Org1MSP"),
+		"validFrom": "2026-01-01T00:00:00Z",
+		"credentialSchema": map[string]interface{}{
+			"id":   credential.ProductSchemaURL,
+			"type": "JsonSchema",
+		},
+		"credentialSubject": map[string]interface{}{
+			"id": credential.SubjectID("PRODUCT-00001"),
+			"product": map[string]interface{}{
+				"ID":        "PRODUCT-00001",
+				"modelID":   "MODEL-00001",
+				"modelName": "GalaxyS7",
+				"make":      "SAMSUNG",
+				"status":    1,
+			},
+			"custody": []interface{}{},
+			"service": map[string]interface{}{
+				"firmwareUpdates": []interface{}{},
+				"rmas":            []interface{}{},
+			},
+		},
+	}
+	if edit != nil {
+		edit(document)
+	}
+	data, err := json.Marshal(document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func sign(t *testing.T, document []byte, keyID string, privateKey ed25519.PrivateKey) []byte {
+	secured, err := credential.Sign(document, credential.VerificationMethod("Org1MSP", keyID), "2026-01-01T00:00:00Z", privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secured
+}
+
+func TestVerify(t *testing.T) {
+	valid := sign(t, unsigned(t, nil), "key-1", manufacturerKey)
+	tampered := bytes.Replace(valid, []byte(`"GalaxyS7"`), []byte(`"GalaxyS8"`), 1)
+
+	tests := []struct {
+		name     string
+		document []byte
+		wantErr  error
+	}{
+		{name: "valid", document: valid},
+		{name: "tampered payload", document: tampered, wantErr: credential.ErrBadSignature},
+		{name: "signed with another key", document: sign(t, unsigned(t, nil), "key-1", otherKey), wantErr: credential.ErrBadSignature},
+		{name: "unregistered key", document: sign(t, unsigned(t, nil), "key-2", manufacturerKey), wantErr: credential.ErrUnknownKey},
+		{
+			name: "unknown context",
+			document: sign(t, unsigned(t, func(document map[string]interface{}) {
+				document["@context"] = []interface{}{credential.CredentialsContextURL, "https://example.com/contexts/v1"}
+			}), "key-1", manufacturerKey),
+			wantErr: credential.ErrUnknownSource,
+		},
+		{
+			name: "credentials context not first",
+			document: sign(t, unsigned(t, func(document map[string]interface{}) {
+				document["@context"] = []interface{}{credential.ProductContextURL, credential.CredentialsContextURL}
+			}), "key-1", manufacturerKey),
+			wantErr: credential.ErrMalformed,
+		},
+		{
+			name: "unknown schema",
+			document: sign(t, unsigned(t, func(document map[string]interface{}) {
+				document["credentialSchema"] = map[string]interface{}{"id": "https://example.com/schemas/v1", "type": "JsonSchema"}
+			}), "key-1", manufacturerKey),
+			wantErr: credential.ErrUnknownSource,
+		},
+		{name: "no proof", document: unsigned(t, nil), wantErr: credential.ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verified, err := credential.Verify(tt.document, testKeys())
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("Verify() error = %v", err)
+				}
+				if verified.ProductID != "PRODUCT-00001" || verified.MSPID != "Org1MSP" || verified.KeyID != "key-1" {
+					t.Fatalf("Verify() = %+v", verified)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifySchemaViolation(t *testing.T) {
+	document := sign(t, unsigned(t, func(document map[string]interface{}) {
+		delete(document["credentialSubject"].(map[string]interface{}), "custody")
+	}), "key-1", manufacturerKey)
+
+	_, err := credential.Verify(document, testKeys())
+	if err == nil || !strings.Contains(err.Error(), "custody") {
+		t.Fatalf("Verify() error = %v, want a missing custody error", err)
+	}
+}
+
+func TestDocument(t *testing.T) {
+	tests := []struct {
+		url   string
+		found bool
+	}{
+		{url: credential.CredentialsContextURL, found: true},
+		{url: credential.ProductContextURL, found: true},
+		{url: credential.ProductSchemaURL, found: true},
+		{url: "https://www.w3.org/2018/credentials/v1", found: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			document, found := credential.Document(tt.url)
+			if found != tt.found {
+				t.Fatalf("Document() found = %v, want %v", found, tt.found)
+			}
+			if found && !json.Valid([]byte(document)) {
+				t.Fatalf("Document() is not valid JSON")
+			}
+		})
+	}
+}
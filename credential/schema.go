@@ -0,0 +1,98 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package credential
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// validateSchema checks a decoded JSON value against the subset of JSON Schema the embedded
+// schemas use: type, required, properties, items, contains and const.
+func validateSchema(schema map[string]interface{}, value interface{}, path string) error {
+	if expected, ok := schema["type"].(string); ok && !hasType(value, expected) {
+		return fmt.Errorf("%s must be of type %s", path, expected)
+	}
+	if expected, ok := schema["const"]; ok && !reflect.DeepEqual(normalize(expected), normalize(value)) {
+		return fmt.Errorf("%s must be %v", path, expected)
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := value[name.(string)]; !ok {
+					return fmt.Errorf("%s is missing %s", path, name)
+				}
+			}
+		}
+		if properties, ok := schema["properties"].(map[string]interface{}); ok {
+			for name, property := range properties {
+				if v, ok := value[name]; ok {
+					if err := validateSchema(property.(map[string]interface{}), v, path+"."+name); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range value {
+				if err := validateSchema(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+		if contains, ok := schema["contains"].(map[string]interface{}); ok {
+			found := false
+			for _, item := range value {
+				if validateSchema(contains, item, path) == nil {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("%s has no item matching %v", path, contains)
+			}
+		}
+	}
+	return nil
+}
+
+func hasType(value interface{}, expected string) bool {
+	switch value := value.(type) {
+	case nil:
+		return expected == "null"
+	case bool:
+		return expected == "boolean"
+	case string:
+		return expected == "string"
+	case json.Number:
+		if expected == "integer" {
+			_, err := value.Int64()
+			return err == nil && !strings.ContainsAny(string(value), ".eE")
+		}
+		return expected == "number"
+	case float64:
+		return expected == "number" || (expected == "integer" && value == float64(int64(value)))
+	case []interface{}:
+		return expected == "array"
+	case map[string]interface{}:
+		return expected == "object"
+	}
+	return false
+}
+
+// normalize turns json.Number into float64 so that values decoded either way compare equal.
+func normalize(value interface{}) interface{} {
+	if n, ok := value.(json.Number); ok {
+		f, _ := n.Float64()
+		return f
+	}
+	return value
+}
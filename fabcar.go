@@ -7,17 +7,18 @@ package main
 import (
 	"log"
 
+	"github.com/hyperledger/fabric-chaincode-go/shim"
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 	"github.com/hyperledger/fabric-samples/asset-transfer-fabcar/chaincode-go/chaincode"
 )
 
 func main() {
-	assetChaincode, err := contractapi.NewChaincode(&chaincode.SmartContract{})
+	assetChaincode, err := contractapi.NewChaincode(chaincode.Contracts()...)
 	if err != nil {
 		log.Panicf("Error creating asset-transfer-fabcar chaincode: %v", err)
 	}
 
-	if err := assetChaincode.Start(); err != nil {
+	if err := shim.Start(chaincode.Idempotent(assetChaincode)); err != nil {
 		log.Panicf("Error starting asset-transfer-fabcar chaincode: %v", err)
 	}
 }